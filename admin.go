@@ -0,0 +1,409 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//StaffMember is a hospital coordinator. staff log in with a secret code like
+//users do, but only at /admin/login, and act on users through /admin/
+type StaffMember struct {
+	Id          int      `json:"id"`
+	Name        string   `json:"name"`
+	Role        UserType `json:"role"`                  //Staff or Admin
+	Deactivated bool     `json:"deactivated,omitempty"` //set by an admin, the member can no longer log in
+}
+
+//adminUser is a user as staff see it, with the state of its secret code
+type adminUser struct {
+	User
+	//ok, revoked, deactivated, or mismatched when the secret code mappings
+	//are broken and the user needs a repair
+	Status string `json:"status"`
+}
+
+//requireStaff resolves a staff caller from the bearer token before calling
+//next. with admin set only Admin staff are let through
+func (h *usersHandler) requireStaff(admin bool, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		claims, err := h.authenticate(r)
+		if err != nil {
+			writeUnauthorized(w, err)
+			return
+		}
+		if claims.Type != Staff && claims.Type != Admin || admin && claims.Type != Admin {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(fmt.Sprintf("err: not allowed for your role")))
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), callerKey{}, claims)))
+	}
+}
+
+// /admin/
+func (h *usersHandler) admin(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimSuffix(r.URL.Path, "/"), "/")
+	partsLen := len(parts)
+
+	switch {
+	// /admin/login
+	case partsLen == 3 && parts[2] == "login" && r.Method == "POST":
+		h.adminLogin(w, r)
+
+	// /admin/users
+	case partsLen == 3 && parts[2] == "users" && r.Method == "GET":
+		h.requireStaff(false, h.adminListUsers)(w, r)
+
+	// /admin/users/{id}/{action}
+	case partsLen == 5 && parts[2] == "users" && r.Method == "POST":
+		switch parts[4] {
+		case "deactivate":
+			h.requireStaff(false, func(w http.ResponseWriter, r *http.Request) {
+				h.setDeactivated(w, r, parts[3], true)
+			})(w, r)
+		case "reactivate":
+			h.requireStaff(false, func(w http.ResponseWriter, r *http.Request) {
+				h.setDeactivated(w, r, parts[3], false)
+			})(w, r)
+		case "repair":
+			h.requireStaff(false, func(w http.ResponseWriter, r *http.Request) {
+				h.repairUser(w, r, parts[3])
+			})(w, r)
+		case "urgency":
+			h.requireStaff(false, func(w http.ResponseWriter, r *http.Request) {
+				h.setUrgency(w, r, parts[3])
+			})(w, r)
+		case "revoke":
+			h.requireStaff(true, func(w http.ResponseWriter, r *http.Request) {
+				h.revokeSecret(w, r, parts[3])
+			})(w, r)
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(fmt.Sprintf("err:  check request url path")))
+		}
+
+	// /admin/users/{id}/disconnect/{id}
+	case partsLen == 6 && parts[2] == "users" && parts[4] == "disconnect" && r.Method == "POST":
+		h.requireStaff(false, func(w http.ResponseWriter, r *http.Request) {
+			h.forceDisconnect(w, r, parts[3], parts[5])
+		})(w, r)
+
+	// /admin/waitlist
+	case partsLen == 3 && parts[2] == "waitlist" && r.Method == "GET":
+		h.requireStaff(false, h.getWaitlist)(w, r)
+
+	// /admin/logins
+	case partsLen == 3 && parts[2] == "logins" && r.Method == "GET":
+		h.requireStaff(false, h.loginStats)(w, r)
+
+	// /admin/audit
+	case partsLen == 3 && parts[2] == "audit" && r.Method == "GET":
+		h.requireStaff(true, h.queryAudit)(w, r)
+
+	// /admin/fsck
+	case partsLen == 3 && parts[2] == "fsck" && r.Method == "GET":
+		h.requireStaff(true, h.fsck(false))(w, r)
+
+	// /admin/fsck/repair
+	case partsLen == 4 && parts[2] == "fsck" && parts[3] == "repair" && r.Method == "POST":
+		h.requireStaff(true, h.fsck(true))(w, r)
+
+	// /admin/staff
+	case partsLen == 3 && parts[2] == "staff" && r.Method == "GET":
+		h.requireStaff(true, h.listStaff)(w, r)
+
+	case partsLen == 3 && parts[2] == "staff" && r.Method == "POST":
+		h.requireStaff(true, h.createStaff)(w, r)
+
+	// /admin/staff/{id}/{action}
+	case partsLen == 5 && parts[2] == "staff" && r.Method == "POST":
+		switch parts[4] {
+		case "deactivate":
+			h.requireStaff(true, func(w http.ResponseWriter, r *http.Request) {
+				h.setStaffDeactivated(w, r, parts[3], true)
+			})(w, r)
+		case "reactivate":
+			h.requireStaff(true, func(w http.ResponseWriter, r *http.Request) {
+				h.setStaffDeactivated(w, r, parts[3], false)
+			})(w, r)
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(fmt.Sprintf("err:  check request url path")))
+		}
+
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("err:  check request url path")))
+	}
+}
+
+// POST /admin/login
+func (h *usersHandler) adminLogin(w http.ResponseWriter, r *http.Request) {
+	config, ok := h.checkSecretCode(w, r, Staff, Admin)
+	if !ok {
+		return
+	}
+
+	member, err := h.store.GetStaff(config.Id)
+	if err != nil {
+		writeStoreError(w, err, "StaffId")
+		return
+	}
+	if member.Deactivated {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(fmt.Sprintf("err: Account deactivated. Contact Admin")))
+		return
+	}
+
+	token, expires, err := h.sessions.issue(config)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	type Data struct {
+		StaffInfo StaffMember `json:"staff_data"`
+		Token     string      `json:"token"` //send as Authorization: Bearer {token} on /admin/ actions
+		ExpiresAt time.Time   `json:"expires_at"`
+	}
+
+	writeJSON(w, http.StatusOK, Data{
+		StaffInfo: member,
+		Token:     token,
+		ExpiresAt: expires,
+	})
+}
+
+// GET /admin/users
+//adminListUsers lists every patient and donor with full contact details,
+//including deactivated users and users whose secret code mappings are broken
+func (h *usersHandler) adminListUsers(w http.ResponseWriter, r *http.Request) {
+	view := func(t UserType) []adminUser {
+		users := h.store.ListUsers(t)
+		list := make([]adminUser, 0, len(users))
+		for _, user := range users {
+			status := "ok"
+			cred, err := h.store.Credential(user.Id)
+			if _, e := h.store.GetUser(user.Id); e != nil || err != nil {
+				status = "mismatched"
+			} else if cred.Revoked {
+				status = "revoked"
+			} else if user.Deactivated {
+				status = "deactivated"
+			}
+			list = append(list, adminUser{User: user, Status: status})
+		}
+		return list
+	}
+
+	writeJSON(w, http.StatusOK, map[string][]adminUser{
+		"patients": view(Patient),
+		"donors":   view(Donor),
+	})
+}
+
+//setDeactivated deactivates or reactivates the user with id t. a deactivated
+//user cannot log in, its sessions stop working and it cannot be requested
+func (h *usersHandler) setDeactivated(w http.ResponseWriter, r *http.Request, t string, deactivated bool) {
+	userId, err := strconv.Atoi(t)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("err: invalid User id. Check Input UserId")))
+		return
+	}
+
+	kind := EventReactivateUser
+	if deactivated {
+		kind = EventDeactivateUser
+	}
+	user, err := h.store.UpdateUser(audited(r), kind, userId, func(user *User) error {
+		if user.Deactivated == deactivated {
+			return errNoChange
+		}
+		user.Deactivated = deactivated
+		return nil
+	})
+	if err != nil {
+		writeStoreError(w, err, "UserId")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, user)
+}
+
+//repairUser fixes a user stuck on "UserId and Secret Code Mismatched" by
+//issuing it a new secret code, which staff pass on to the user
+func (h *usersHandler) repairUser(w http.ResponseWriter, r *http.Request, t string) {
+	userId, err := strconv.Atoi(t)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("err: invalid User id. Check Input UserId")))
+		return
+	}
+
+	code, err := issueSecretCode(func(cred SecretCredential) error {
+		_, err := h.store.RepairUser(audited(r), userId, cred)
+		return err
+	})
+	if err != nil {
+		writeStoreError(w, err, "UserId")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, secretCodeData{
+		UserId:         userId,
+		UserSecretCode: code,
+	})
+}
+
+//forceDisconnect removes every connection and open request between two users
+func (h *usersHandler) forceDisconnect(w http.ResponseWriter, r *http.Request, t string, p string) {
+	userId, err := strconv.Atoi(t)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("err: invalid User id. Check Input UserId")))
+		return
+	}
+	otherId, err := strconv.Atoi(p)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("err: invalid User id. Check Input UserId")))
+		return
+	}
+
+	err = h.store.UpdatePair(audited(r), EventForceDisconnect, userId, otherId, func(tx *pairTx) error {
+		changed := tx.disconnect()
+		if dropRequest(tx.requests, tx.user, tx.counterpart) {
+			changed = true
+		}
+		if dropRequest(tx.requests, tx.counterpart, tx.user) {
+			changed = true
+		}
+		if !changed {
+			return errNoChange
+		}
+		return nil
+	})
+	if err != nil {
+		writeStoreError(w, err, "UserId")
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(fmt.Sprintf("users disconnected. ids: %d, %d", userId, otherId)))
+}
+
+// GET /admin/staff
+func (h *usersHandler) listStaff(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, h.store.ListStaff())
+}
+
+// POST /admin/staff
+//createStaff registers a staff member and returns its secret code
+func (h *usersHandler) createStaff(w http.ResponseWriter, r *http.Request) {
+	bodyBytes, err := ioutil.ReadAll(r.Body)
+	defer r.Body.Close()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	var member StaffMember
+	if err := json.Unmarshal(bodyBytes, &member); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if member.Name == "" {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		w.Write([]byte(fmt.Sprintf("err:  required name but got empty string")))
+		return
+	}
+	if member.Role != Staff && member.Role != Admin {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		w.Write([]byte(fmt.Sprintf("err: enter valid staff role. \n 2: Staff \n 3: Admin")))
+		return
+	}
+
+	code, member, err := h.addStaff(audited(r), member)
+	if err != nil {
+		writeStoreError(w, err, "StaffId")
+		return
+	}
+
+	type Data struct {
+		StaffInfo       StaffMember `json:"staff_data"`
+		StaffSecretCode string      `json:"staff_secret_code"`
+	}
+
+	writeJSON(w, http.StatusOK, Data{
+		StaffInfo:       member,
+		StaffSecretCode: code,
+	})
+}
+
+//setStaffDeactivated deactivates or reactivates the staff member with id t. a
+//deactivated member cannot log in and its sessions stop working. admins can
+//not deactivate themselves, so there is always one left to undo it
+func (h *usersHandler) setStaffDeactivated(w http.ResponseWriter, r *http.Request, t string, deactivated bool) {
+	staffId, err := strconv.Atoi(t)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("err: invalid Staff id. Check Input StaffId")))
+		return
+	}
+	if caller, _ := callerOf(r); deactivated && caller.UserId == staffId {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("err: you can not deactivate yourself")))
+		return
+	}
+
+	kind := EventReactivateStaff
+	if deactivated {
+		kind = EventDeactivateStaff
+	}
+	member, err := h.store.UpdateStaff(audited(r), kind, staffId, func(member *StaffMember) error {
+		if member.Deactivated == deactivated {
+			return errNoChange
+		}
+		member.Deactivated = deactivated
+		return nil
+	})
+	if err != nil {
+		writeStoreError(w, err, "StaffId")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, member)
+}
+
+func (h *usersHandler) addStaff(by *AuditEntry, member StaffMember) (string, StaffMember, error) {
+	code, err := issueSecretCode(func(cred SecretCredential) error {
+		created, err := h.store.CreateStaff(by, member, cred)
+		member = created
+		return err
+	})
+	return code, member, err
+}
+
+//bootstrapAdmin creates a first Admin when the store has no staff at all and
+//prints its secret code, the only time it is ever shown
+func (h *usersHandler) bootstrapAdmin(name string) error {
+	if len(h.store.ListStaff()) > 0 {
+		return nil
+	}
+	code, member, err := h.addStaff(nil, StaffMember{Name: name, Role: Admin})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("created admin %q, id: %d. secret code: %s\n", member.Name, member.Id, code)
+	return nil
+}
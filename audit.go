@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//AuditEntry records who did what to whom. every entry carries the hash of the
+//one before it, so editing or dropping an entry breaks the chain after it.
+//hashes are keyed, so the chain can not be rebuilt by someone without the key
+type AuditEntry struct {
+	Seq           int       `json:"seq"`
+	Time          time.Time `json:"time"`
+	ActorId       int       `json:"actor_id"`
+	ActorType     UserType  `json:"actor_type"`
+	Action        string    `json:"action"`
+	TargetId      int       `json:"target_id"`
+	CounterpartId int       `json:"counterpart_id,omitempty"`
+	Ip            string    `json:"ip"`
+	PrevHash      string    `json:"prev_hash"`
+	Hash          string    `json:"hash"`
+}
+
+//auditKey derives the key audit entries are hashed with from the session key
+func auditKey(sessionKey []byte) []byte {
+	mac := hmac.New(sha256.New, sessionKey)
+	mac.Write([]byte("audit trail"))
+	return mac.Sum(nil)
+}
+
+//auditLog is the append-only audit trail. entries are chained by the store as
+//it commits the events they belong to. they are kept in memory for queries
+//and, with a path, appended to a file as json lines
+type auditLog struct {
+	sync.Mutex
+	key     []byte
+	file    *os.File
+	entries []AuditEntry
+	//the last entry the store committed, which the trail has to end with
+	headSeq  int
+	headHash string
+}
+
+func auditPath(dataFile string) string {
+	return dataFile + ".audit"
+}
+
+//sign is the hmac of entry, computed over every field but Hash itself
+func (a *auditLog) sign(entry AuditEntry) string {
+	entry.Hash = ""
+	data, _ := json.Marshal(entry)
+	mac := hmac.New(sha256.New, a.key)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+//openAuditLog loads the trail at path, an empty path keeps it in memory only.
+//a torn last line left by a crash mid-append is cut off so later entries
+//start on a clean line. its entry is in the journal with its event, and is
+//written again when the store catches the trail up
+func openAuditLog(path string, key []byte) (*auditLog, error) {
+	a := &auditLog{key: key}
+	if path == "" {
+		return a, nil
+	}
+
+	if file, err := os.Open(path); err == nil {
+		var offset int64
+		reader := bufio.NewReader(file)
+		for {
+			line, err := reader.ReadBytes('\n')
+			if err == io.EOF {
+				if len(line) > 0 {
+					fmt.Fprintf(os.Stderr, "audit %s: cutting off a torn entry after seq %d\n", path, len(a.entries))
+					if err := os.Truncate(path, offset); err != nil {
+						file.Close()
+						return nil, err
+					}
+				}
+				break
+			}
+			if err != nil {
+				file.Close()
+				return nil, err
+			}
+			offset += int64(len(line))
+			var entry AuditEntry
+			if err := json.Unmarshal(line, &entry); err != nil {
+				file.Close()
+				return nil, fmt.Errorf("audit %s: bad entry after seq %d: %v", path, len(a.entries), err)
+			}
+			a.entries = append(a.entries, entry)
+		}
+		file.Close()
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	a.file = file
+	return a, nil
+}
+
+//append writes out entry, chained and signed by the store already
+func (a *auditLog) append(entry AuditEntry) error {
+	a.Lock()
+	defer a.Unlock()
+
+	a.headSeq, a.headHash = entry.Seq, entry.Hash
+	return a.write(entry)
+}
+
+//write appends entry to the file and the entries. caller must hold the lock
+func (a *auditLog) write(entry AuditEntry) error {
+	if a.file != nil {
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		if _, err := a.file.Write(append(data, '\n')); err != nil {
+			return err
+		}
+		if err := a.file.Sync(); err != nil {
+			return err
+		}
+	}
+	a.entries = append(a.entries, entry)
+	return nil
+}
+
+//catchUp writes the entries of journaled the trail is missing, those of
+//events committed while the server stopped before writing their entry. seq
+//and hash are the last entry the store committed. it fails when the trail
+//does not end with that entry after all
+func (a *auditLog) catchUp(journaled []AuditEntry, seq int, hash string) error {
+	a.Lock()
+	defer a.Unlock()
+
+	a.headSeq, a.headHash = seq, hash
+	for _, entry := range journaled {
+		if entry.Seq != len(a.entries)+1 {
+			continue
+		}
+		if err := a.write(entry); err != nil {
+			return err
+		}
+	}
+	if last := len(a.entries); last != seq || last > 0 && a.entries[last-1].Hash != hash {
+		return fmt.Errorf("audit trail ends at entry %d, the store committed %d", last, seq)
+	}
+	return nil
+}
+
+//verify walks the chain and returns the seq of the first entry that does not
+//match its hash or its predecessor, or is missing from the end of the trail,
+//or 0 if the trail is intact
+func (a *auditLog) verify() int {
+	a.Lock()
+	defer a.Unlock()
+
+	prev := ""
+	for i, entry := range a.entries {
+		if entry.Seq != i+1 || entry.PrevHash != prev || a.sign(entry) != entry.Hash {
+			return i + 1
+		}
+		prev = entry.Hash
+	}
+	if len(a.entries) < a.headSeq {
+		return len(a.entries) + 1
+	}
+	if a.headSeq > 0 && a.entries[a.headSeq-1].Hash != a.headHash {
+		return a.headSeq
+	}
+	if len(a.entries) > a.headSeq {
+		return a.headSeq + 1
+	}
+	return 0
+}
+
+//auditFilter selects entries for query. zero fields match everything
+type auditFilter struct {
+	ActorId  int
+	TargetId int //matches the target or the counterpart
+	Action   string
+	Since    time.Time
+	Until    time.Time
+	Limit    int //newest entries are kept
+}
+
+func (a *auditLog) query(f auditFilter) []AuditEntry {
+	a.Lock()
+	defer a.Unlock()
+
+	list := []AuditEntry{}
+	for _, entry := range a.entries {
+		if f.ActorId != 0 && entry.ActorId != f.ActorId {
+			continue
+		}
+		if f.TargetId != 0 && entry.TargetId != f.TargetId && entry.CounterpartId != f.TargetId {
+			continue
+		}
+		if f.Action != "" && entry.Action != f.Action {
+			continue
+		}
+		if !f.Since.IsZero() && entry.Time.Before(f.Since) {
+			continue
+		}
+		if !f.Until.IsZero() && !entry.Time.Before(f.Until) {
+			continue
+		}
+		list = append(list, entry)
+	}
+	if f.Limit > 0 && len(list) > f.Limit {
+		list = list[len(list)-f.Limit:]
+	}
+	return list
+}
+
+//audited starts the audit entry of a store change made by the caller of r.
+//the store fills in what was done to whom. without a session the caller is
+//the user the change is made to, whose type the handler sets
+func audited(r *http.Request) *AuditEntry {
+	entry := &AuditEntry{Ip: clientIp(r)}
+	if claims, ok := callerOf(r); ok {
+		entry.ActorId = claims.UserId
+		entry.ActorType = claims.Type
+	}
+	return entry
+}
+
+// GET /admin/audit?actor=&target=&action=&since=&until=&limit=
+//queryAudit lists audit entries, since and until are RFC 3339 times
+func (h *usersHandler) queryAudit(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	var f auditFilter
+	var err error
+
+	if v := q.Get("actor"); v != "" {
+		if f.ActorId, err = strconv.Atoi(v); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(fmt.Sprintf("err: invalid actor id")))
+			return
+		}
+	}
+	if v := q.Get("target"); v != "" {
+		if f.TargetId, err = strconv.Atoi(v); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(fmt.Sprintf("err: invalid target id")))
+			return
+		}
+	}
+	if v := q.Get("since"); v != "" {
+		if f.Since, err = time.Parse(time.RFC3339, v); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(fmt.Sprintf("err: invalid since, use RFC 3339")))
+			return
+		}
+	}
+	if v := q.Get("until"); v != "" {
+		if f.Until, err = time.Parse(time.RFC3339, v); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(fmt.Sprintf("err: invalid until, use RFC 3339")))
+			return
+		}
+	}
+	if v := q.Get("limit"); v != "" {
+		if f.Limit, err = strconv.Atoi(v); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(fmt.Sprintf("err: invalid limit")))
+			return
+		}
+	}
+	f.Action = q.Get("action")
+
+	type Data struct {
+		Entries []AuditEntry `json:"entries"`
+		//BrokenAt is the seq of the first tampered entry, 0 if the chain is intact
+		BrokenAt int `json:"broken_at"`
+	}
+
+	writeJSON(w, http.StatusOK, Data{
+		Entries:  h.auditLog.query(f),
+		BrokenAt: h.auditLog.verify(),
+	})
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+//BloodGroup is an ABO group with its Rh(D) sign, e.g. "AB-"
+type BloodGroup string
+
+var bloodGroups = []BloodGroup{"A+", "A-", "B+", "B-", "AB+", "AB-", "O+", "O-"}
+
+//parseBloodGroup normalizes what a user typed, e.g. "ab pos" or "o neg"
+func parseBloodGroup(input string) (BloodGroup, error) {
+	s := strings.ToUpper(strings.Join(strings.Fields(input), ""))
+	s = strings.NewReplacer("POSITIVE", "+", "NEGATIVE", "-", "POS", "+", "NEG", "-", "0", "O").Replace(s)
+	for _, g := range bloodGroups {
+		if BloodGroup(s) == g {
+			return g, nil
+		}
+	}
+	return "", fmt.Errorf("err: enter valid blood group. one of %v", bloodGroups)
+}
+
+//antigens are the ABO antigens on the red cells of g
+func (g BloodGroup) antigens() string {
+	return strings.Trim(string(g), "+-O")
+}
+
+func (g BloodGroup) rhPositive() bool {
+	return strings.HasSuffix(string(g), "+")
+}
+
+//Component is a part of a blood donation, each with its own compatibility rules
+type Component string
+
+const (
+	RedCells  Component = "red_cells"
+	Plasma    Component = "plasma"
+	Platelets Component = "platelets"
+	Organ     Component = "organ"
+)
+
+//Compatibility of a donor and recipient for one component
+type Compatibility string
+
+const (
+	Compatible   Compatibility = "compatible"
+	Caution      Compatibility = "caution" //acceptable when nothing better is available
+	Incompatible Compatibility = "incompatible"
+	Unknown      Compatibility = "unknown" //one of the groups is not on record
+)
+
+//hasAll reports whether every antigen of sub is in antigens
+func hasAll(antigens string, sub string) bool {
+	for _, a := range sub {
+		if !strings.ContainsRune(antigens, a) {
+			return false
+		}
+	}
+	return true
+}
+
+//compatibility of donor for recipient when transfusing c.
+//red cells must not carry an ABO antigen the recipient lacks, and Rh(D)
+//positive cells are never given to a negative recipient. plasma works the
+//other way round: the recipient's antigens must all be on the donor's cells,
+//otherwise the donor's antibodies attack them; Rh does not matter. platelets
+//are preferably plasma compatible and Rh matched, but ABO or Rh mismatched
+//platelets are given when nothing else is available. organs follow the red
+//cell ABO rule, Rh does not matter for them
+func compatibility(c Component, donor BloodGroup, recipient BloodGroup) Compatibility {
+	if donor == "" || recipient == "" {
+		return Unknown
+	}
+	rhMismatch := donor.rhPositive() && !recipient.rhPositive()
+
+	switch c {
+	case RedCells:
+		if !hasAll(recipient.antigens(), donor.antigens()) || rhMismatch {
+			return Incompatible
+		}
+	case Plasma:
+		if !hasAll(donor.antigens(), recipient.antigens()) {
+			return Incompatible
+		}
+	case Platelets:
+		if !hasAll(donor.antigens(), recipient.antigens()) || rhMismatch {
+			return Caution
+		}
+	case Organ:
+		if !hasAll(recipient.antigens(), donor.antigens()) {
+			return Incompatible
+		}
+	}
+	return Compatible
+}
+
+//blood check modes, set with -blood-check
+const (
+	bloodCheckReject = "reject" //incompatible pairs cannot be requested or connected
+	bloodCheckWarn   = "warn"   //they can, but the response carries a warning
+	bloodCheckOff    = "off"
+)
+
+//donorAndPatient orders a pair of users
+func donorAndPatient(a User, b User) (User, User) {
+	if a.Type == Patient {
+		return b, a
+	}
+	return a, b
+}
+
+//checkBlood applies the blood check to a patient and donor about to be
+//requested or connected. the pair passes if the donor's blood is compatible
+//for any donation type the two have in common. it returns a warning for the
+//response, or an httpError when the pair is rejected
+func (h *usersHandler) checkBlood(a User, b User) (string, error) {
+	if h.bloodCheck == bloodCheckOff {
+		return "", nil
+	}
+	donor, patient := donorAndPatient(a, b)
+
+	switch best, _ := bestCompatibility(sharedTypes(donor, patient), donor, patient); best {
+	case Unknown:
+		return fmt.Sprintf("warning: blood group of donorId: %d or patientId: %d is not on record, compatibility was not checked", donor.Id, patient.Id), nil
+	case Incompatible:
+		msg := fmt.Sprintf("donor blood group %s is incompatible with patient blood group %s for %s", donor.BloodGroup, patient.BloodGroup, strings.Join(sharedTypes(donor, patient), ", "))
+		if h.bloodCheck == bloodCheckWarn {
+			return "warning: " + msg, nil
+		}
+		return "", &httpError{http.StatusUnprocessableEntity, "err: " + msg}
+	}
+	return "", nil
+}
+
+//bloodCheckData answers sendRequest and acceptRequest
+type bloodCheckData struct {
+	//blood group compatibility for each type offered by the donor and needed by the patient
+	Compatibility map[string]Compatibility `json:"compatibility"`
+	Warning       string                   `json:"warning,omitempty"`
+	Request       *Request                 `json:"request,omitempty"`    //the request sent or accepted
+	Connection    *Connection              `json:"connection,omitempty"` //the record acceptRequest created
+}
+
+//writeBloodCheck answers a request between a and b that went through
+func writeBloodCheck(w http.ResponseWriter, a User, b User, warning string, request *Request, connection *Connection) {
+	donor, patient := donorAndPatient(a, b)
+	compat := map[string]Compatibility{}
+	for _, t := range sharedTypes(donor, patient) {
+		compat[t] = typeCompatibility(t, donor, patient)
+	}
+	writeJSON(w, http.StatusOK, bloodCheckData{
+		Compatibility: compat,
+		Warning:       warning,
+		Request:       request,
+		Connection:    connection,
+	})
+}
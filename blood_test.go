@@ -0,0 +1,90 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+//compatibility tables, one row per donor and one column per recipient, both
+//in the order A+ A- B+ B- AB+ AB- O+ O-. C is compatible, ~ caution and
+//x incompatible
+var compatibilityTables = []struct {
+	component Component
+	rows      map[BloodGroup]string
+}{
+	{RedCells, map[BloodGroup]string{
+		"A+":  "C x x x C x x x",
+		"A-":  "C C x x C C x x",
+		"B+":  "x x C x C x x x",
+		"B-":  "x x C C C C x x",
+		"AB+": "x x x x C x x x",
+		"AB-": "x x x x C C x x",
+		"O+":  "C x C x C x C x",
+		"O-":  "C C C C C C C C",
+	}},
+	{Plasma, map[BloodGroup]string{
+		"A+":  "C C x x x x C C",
+		"A-":  "C C x x x x C C",
+		"B+":  "x x C C x x C C",
+		"B-":  "x x C C x x C C",
+		"AB+": "C C C C C C C C",
+		"AB-": "C C C C C C C C",
+		"O+":  "x x x x x x C C",
+		"O-":  "x x x x x x C C",
+	}},
+	{Platelets, map[BloodGroup]string{
+		"A+":  "C ~ ~ ~ ~ ~ C ~",
+		"A-":  "C C ~ ~ ~ ~ C C",
+		"B+":  "~ ~ C ~ ~ ~ C ~",
+		"B-":  "~ ~ C C ~ ~ C C",
+		"AB+": "C ~ C ~ C ~ C ~",
+		"AB-": "C C C C C C C C",
+		"O+":  "~ ~ ~ ~ ~ ~ C ~",
+		"O-":  "~ ~ ~ ~ ~ ~ C C",
+	}},
+	{Organ, map[BloodGroup]string{
+		"A+":  "C C x x C C x x",
+		"A-":  "C C x x C C x x",
+		"B+":  "x x C C C C x x",
+		"B-":  "x x C C C C x x",
+		"AB+": "x x x x C C x x",
+		"AB-": "x x x x C C x x",
+		"O+":  "C C C C C C C C",
+		"O-":  "C C C C C C C C",
+	}},
+}
+
+var compatibilityMarks = map[string]Compatibility{"C": Compatible, "~": Caution, "x": Incompatible}
+
+func TestCompatibility(t *testing.T) {
+	for _, table := range compatibilityTables {
+		if len(table.rows) != len(bloodGroups) {
+			t.Fatalf("%s: %d donor rows, want %d", table.component, len(table.rows), len(bloodGroups))
+		}
+		for donor, row := range table.rows {
+			marks := strings.Fields(row)
+			if len(marks) != len(bloodGroups) {
+				t.Fatalf("%s: donor %s has %d columns, want %d", table.component, donor, len(marks), len(bloodGroups))
+			}
+			for i, recipient := range bloodGroups {
+				want := compatibilityMarks[marks[i]]
+				if got := compatibility(table.component, donor, recipient); got != want {
+					t.Errorf("%s: donor %s, recipient %s: got %s, want %s", table.component, donor, recipient, got, want)
+				}
+			}
+		}
+	}
+}
+
+func TestCompatibilityUnknownGroup(t *testing.T) {
+	for _, c := range []Component{RedCells, Plasma, Platelets, Organ} {
+		for _, g := range bloodGroups {
+			if got := compatibility(c, "", g); got != Unknown {
+				t.Errorf("%s: no donor group, recipient %s: got %s, want %s", c, g, got, Unknown)
+			}
+			if got := compatibility(c, g, ""); got != Unknown {
+				t.Errorf("%s: donor %s, no recipient group: got %s, want %s", c, g, got, Unknown)
+			}
+		}
+	}
+}
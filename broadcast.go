@@ -0,0 +1,308 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+//broadcast states
+const (
+	BroadcastOpen   = "open"
+	BroadcastFilled = "filled" //closed once enough donors accepted
+	BroadcastClosed = "closed" //closed by the patient before that
+)
+
+//response of a donor to a broadcast
+const (
+	ResponsePending   = "pending"
+	ResponseAccepted  = "accepted"
+	ResponseDeclined  = "declined"
+	ResponseCancelled = "cancelled" //the broadcast closed before the donor answered
+	ResponseWithdrawn = "withdrawn" //the request was dropped some other way
+)
+
+const (
+	defaultBroadcastRadiusKm = 25
+	maxBroadcastRadiusKm     = 500
+)
+
+//Broadcast is an emergency request of a critical patient, sent at once to every
+//eligible, compatible donor within RadiusKm
+type Broadcast struct {
+	Id           int            `json:"id"`
+	PatientId    int            `json:"patient_id"`
+	CreatedAt    time.Time      `json:"created_at"`
+	ClosedAt     *time.Time     `json:"closed_at,omitempty"`
+	RadiusKm     float64        `json:"radius_km"`
+	DonorsNeeded int            `json:"donors_needed"`
+	Status       string         `json:"status"`
+	Responses    map[int]string `json:"responses"` //map[donorId] = response
+}
+
+func cloneBroadcast(b Broadcast) Broadcast {
+	responses := make(map[int]string, len(b.Responses))
+	for id, response := range b.Responses {
+		responses[id] = response
+	}
+	b.Responses = responses
+	if b.ClosedAt != nil {
+		at := *b.ClosedAt
+		b.ClosedAt = &at
+	}
+	return b
+}
+
+//count returns how many donors gave response
+func (b Broadcast) count(response string) int {
+	n := 0
+	for _, r := range b.Responses {
+		if r == response {
+			n++
+		}
+	}
+	return n
+}
+
+//close ends b with status, cancelling the requests still pending. users holds
+//the patient and the donors of b, requests the pending requests among them
+func (b *Broadcast) close(status string, users map[int]*User, requests *requestBook, at time.Time) {
+	patient := users[b.PatientId]
+	for id, response := range b.Responses {
+		if response != ResponsePending {
+			continue
+		}
+		if donor, ok := users[id]; ok && patient != nil && requests != nil {
+			dropRequest(requests, patient, donor)
+		}
+		b.Responses[id] = ResponseCancelled
+	}
+	b.Status = status
+	b.ClosedAt = &at
+}
+
+//syncBroadcasts brings the responses of open broadcasts touching the users
+//with ids in line with their requests: a donor connected to the patient has
+//accepted, a request gone otherwise is withdrawn. a broadcast whose patient is
+//gone is closed, dated at
+func (hs *Hospital) syncBroadcasts(ids []int, at time.Time) {
+	touched := map[int]bool{}
+	for _, id := range ids {
+		touched[id] = true
+	}
+
+	for key, b := range hs.Broadcasts {
+		if b.Status != BroadcastOpen {
+			continue
+		}
+		relevant := touched[b.PatientId]
+		for id := range b.Responses {
+			relevant = relevant || touched[id]
+		}
+		if !relevant {
+			continue
+		}
+
+		b = cloneBroadcast(b)
+		patient, ok := hs.Patients[b.PatientId]
+		if !ok {
+			b.close(BroadcastClosed, map[int]*User{}, nil, at)
+			hs.Broadcasts[key] = b
+			continue
+		}
+		for id, response := range b.Responses {
+			if response != ResponsePending {
+				continue
+			}
+			switch {
+			case hs.Graph.has(EdgeConnected, patient.Id, id):
+				b.Responses[id] = ResponseAccepted
+			case !hs.Graph.has(EdgeRequested, patient.Id, id):
+				b.Responses[id] = ResponseWithdrawn
+				if r, ok := hs.broadcastRequest(b.Id, id); ok && r.State == RequestDeclined {
+					b.Responses[id] = ResponseDeclined
+				}
+			}
+		}
+		hs.Broadcasts[key] = b
+	}
+}
+
+//broadcastRequest returns the request broadcast with id sent to the donor with donorId
+func (hs *Hospital) broadcastRequest(id int, donorId int) (Request, bool) {
+	for _, r := range hs.Requests {
+		if r.BroadcastId == id && r.RecipientId == donorId {
+			return r, true
+		}
+	}
+	return Request{}, false
+}
+
+//broadcastsOf returns the broadcasts of the patient with id, newest first
+func (hs *Hospital) broadcastsOf(id int) []Broadcast {
+	list := []Broadcast{}
+	for _, b := range hs.Broadcasts {
+		if b.PatientId == id {
+			list = append(list, b)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Id > list[j].Id
+	})
+	return list
+}
+
+// POST /user/{id}/broadcast
+//createBroadcast sends a request from a critical patient to every donor within
+//radius_km that could accept it, nearest first
+func (h *usersHandler) createBroadcast(w http.ResponseWriter, r *http.Request, t string) {
+	userId, err := strconv.Atoi(t)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("err: invalid User id. Check Input UserId")))
+		return
+	}
+
+	bodyBytes, err := ioutil.ReadAll(r.Body)
+	defer r.Body.Close()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	body := struct {
+		RadiusKm     float64 `json:"radius_km"`
+		DonorsNeeded int     `json:"donors_needed"`
+	}{defaultBroadcastRadiusKm, 1}
+	if len(bodyBytes) > 0 {
+		if err := json.Unmarshal(bodyBytes, &body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+	}
+	if body.RadiusKm <= 0 || body.RadiusKm > maxBroadcastRadiusKm {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		w.Write([]byte(fmt.Sprintf("err: radius_km must be above 0 and at most %d", maxBroadcastRadiusKm)))
+		return
+	}
+	if body.DonorsNeeded < 1 {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		w.Write([]byte(fmt.Sprintf("err: donors_needed must be at least 1")))
+		return
+	}
+
+	patient, err := h.store.GetUser(userId)
+	if err != nil {
+		writeStoreError(w, err, "UserId")
+		return
+	}
+	if patient.Location == nil {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		w.Write([]byte(fmt.Sprintf("err: a broadcast needs the patient location on record")))
+		return
+	}
+	hits := h.store.DonorsNear(*patient.Location, body.RadiusKm)
+	donorIds := make([]int, 0, len(hits))
+	for _, hit := range hits {
+		donorIds = append(donorIds, hit.Id)
+	}
+
+	b := Broadcast{PatientId: userId, RadiusKm: body.RadiusKm, DonorsNeeded: body.DonorsNeeded, Status: BroadcastOpen, Responses: map[int]string{}}
+	b, err = h.store.CreateBroadcast(audited(r), b, donorIds, func(b *Broadcast, users map[int]*User, requests *requestBook, links *linkBook) error {
+		patient := users[b.PatientId]
+		if patient.Type != Patient {
+			return &httpError{http.StatusUnprocessableEntity, fmt.Sprintf("err: only patients can broadcast a request")}
+		}
+		if patient.Deactivated {
+			return &httpError{http.StatusForbidden, fmt.Sprintf("err: Account deactivated. Contact Admin")}
+		}
+		if urgencyOf(*patient) != Critical {
+			return &httpError{http.StatusUnprocessableEntity, fmt.Sprintf("err: only critical patients can broadcast a request. patientId: %d is %s", patient.Id, urgencyOf(*patient))}
+		}
+
+		for _, id := range donorIds {
+			donor, ok := users[id]
+			if !ok || donor.Unavailable {
+				continue
+			}
+			if links.has(EdgeRequested, patient.Id, id) || links.has(EdgeRequested, id, patient.Id) || links.has(EdgeConnected, patient.Id, id) {
+				continue
+			}
+			if _, err := h.checkRequest(links, *patient, *donor); err != nil {
+				continue
+			}
+			request := h.addRequest(requests, patient, donor, "")
+			request.BroadcastId = b.Id
+			requests.put(request)
+			b.Responses[id] = ResponsePending
+		}
+		if len(b.Responses) == 0 {
+			return &httpError{http.StatusUnprocessableEntity, fmt.Sprintf("err: no eligible, compatible donor found within %g km", b.RadiusKm)}
+		}
+		return nil
+	})
+	if err != nil {
+		writeStoreError(w, err, "UserId")
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, b)
+}
+
+// GET /user/{id}/broadcast
+func (h *usersHandler) getBroadcasts(w http.ResponseWriter, r *http.Request, t string) {
+	userId, err := strconv.Atoi(t)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("err: invalid User id. Check Input UserId")))
+		return
+	}
+
+	if _, err := h.store.GetUser(userId); err != nil {
+		writeStoreError(w, err, "UserId")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, h.store.Broadcasts(userId))
+}
+
+// DELETE /user/{id}/broadcast/{id}
+//closeBroadcast ends an open broadcast early, cancelling the requests no donor
+//has answered yet
+func (h *usersHandler) closeBroadcast(w http.ResponseWriter, r *http.Request, t string, p string) {
+	userId, err := strconv.Atoi(t)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("err: invalid User id. Check Input UserId")))
+		return
+	}
+	broadcastId, err := strconv.Atoi(p)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("err: invalid Broadcast id. Check Input BroadcastId")))
+		return
+	}
+
+	b, err := h.store.UpdateBroadcast(audited(r), EventCloseBroadcast, broadcastId, func(b *Broadcast, users map[int]*User, requests *requestBook, links *linkBook) error {
+		if b.PatientId != userId {
+			return ErrBroadcastNotFound
+		}
+		if b.Status != BroadcastOpen {
+			return errNoChange
+		}
+		b.close(BroadcastClosed, users, requests, time.Now().UTC())
+		return nil
+	})
+	if err != nil {
+		writeStoreError(w, err, "BroadcastId")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, b)
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+//DeleteSummary is what deleting a user cleaned up
+type DeleteSummary struct {
+	UserId            int   `json:"user_id"`
+	Disconnected      []int `json:"disconnected"`       //counterparts the user was connected to
+	CancelledRequests []int `json:"cancelled_requests"` //ids of the pending requests it sent or received
+	ClosedBroadcasts  []int `json:"closed_broadcasts"`  //ids of its open broadcasts
+	Notified          []int `json:"notified"`           //counterparts told about the deletion
+}
+
+//cascadeDelete builds the event deleting user: its pending requests are
+//cancelled at now and its edges go with it, so every counterpart loses it from
+//its connections. the counterparts are notified when the event is applied
+func (hs *Hospital) cascadeDelete(user User, now time.Time) (Event, DeleteSummary) {
+	summary := DeleteSummary{
+		UserId:            user.Id,
+		Disconnected:      []int{},
+		CancelledRequests: []int{},
+		ClosedBroadcasts:  []int{},
+		Notified:          []int{},
+	}
+	counterparts := map[int]User{}
+	lookup := func(id int) (User, bool) {
+		if c, ok := counterparts[id]; ok {
+			return c, true
+		}
+		c, ok := hs.Donors[id]
+		if !ok {
+			c, ok = hs.Patients[id]
+		}
+		if !ok || c.Type == user.Type {
+			return User{}, false
+		}
+		return cloneUser(c), true
+	}
+
+	for _, id := range hs.Graph.from(EdgeConnected, user.Id) {
+		c, ok := lookup(id)
+		if !ok {
+			continue
+		}
+		counterparts[id] = c
+		summary.Disconnected = append(summary.Disconnected, id)
+	}
+
+	var requests []Request
+	for _, r := range hs.Requests {
+		if r.State != RequestPending || r.SenderId != user.Id && r.RecipientId != user.Id {
+			continue
+		}
+		r.State = RequestCancelled
+		r.UpdatedAt = now
+		requests = append(requests, r)
+		summary.CancelledRequests = append(summary.CancelledRequests, r.Id)
+
+		other := r.SenderId
+		if other == user.Id {
+			other = r.RecipientId
+		}
+		c, ok := lookup(other)
+		if !ok {
+			continue
+		}
+		if r.RecipientId == other && c.Type == Donor && c.RequestsReceived > 0 {
+			c.RequestsReceived -= 1
+		}
+		counterparts[other] = c
+	}
+	sort.Slice(requests, func(i, j int) bool {
+		return requests[i].Id < requests[j].Id
+	})
+
+	for _, b := range hs.Broadcasts {
+		if b.PatientId == user.Id && b.Status == BroadcastOpen {
+			summary.ClosedBroadcasts = append(summary.ClosedBroadcasts, b.Id)
+		}
+	}
+
+	users := make([]User, 0, len(counterparts))
+	for id, c := range counterparts {
+		users = append(users, c)
+		summary.Notified = append(summary.Notified, id)
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Id < users[j].Id
+	})
+	sort.Ints(summary.Disconnected)
+	sort.Ints(summary.CancelledRequests)
+	sort.Ints(summary.ClosedBroadcasts)
+	sort.Ints(summary.Notified)
+
+	ev := Event{Type: EventDeleteUser, UserId: user.Id, Users: users, Deleted: []int{user.Id}, Requests: requests}
+	return ev, summary
+}
+
+//notifyDeleted tells the counterparts in ev.Users that the users deleted by ev
+//are gone. it runs before they are removed
+func (hs *Hospital) notifyDeleted(ev Event) {
+	for _, id := range ev.Deleted {
+		for _, c := range ev.Users {
+			name := strings.ToLower(typeName(otherType(c.Type)))
+			hs.notify(Notification{
+				UserId:        c.Id,
+				Time:          ev.Time,
+				Kind:          NotifyUserDeleted,
+				CounterpartId: id,
+				Text:          fmt.Sprintf("%sId: %d deleted their account. your connection and requests with them were removed", name, id),
+			})
+		}
+	}
+}
+
+//dropBroadcastResponses removes the donors with ids from every broadcast
+func (hs *Hospital) dropBroadcastResponses(ids []int) {
+	for key, b := range hs.Broadcasts {
+		changed := false
+		for _, id := range ids {
+			if _, ok := b.Responses[id]; ok {
+				if !changed {
+					b = cloneBroadcast(b)
+					changed = true
+				}
+				delete(b.Responses, id)
+			}
+		}
+		if changed {
+			hs.Broadcasts[key] = b
+		}
+	}
+}
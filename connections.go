@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+//Connection is the record of a donor and patient connected by acceptRequest.
+//it keeps how well the two matched at the time, and lives as long as their
+//connected edge
+type Connection struct {
+	DonorId       int                      `json:"donor_id"`
+	PatientId     int                      `json:"patient_id"`
+	CreatedAt     time.Time                `json:"created_at,omitempty"` //zero for connections made before records were kept
+	DonationTypes []string                 `json:"donation_types"`
+	Compatibility map[string]Compatibility `json:"compatibility"`
+	HLA           *HLAMatch                `json:"hla,omitempty"`
+}
+
+func connectionKey(donorId int, patientId int) string {
+	return fmt.Sprintf("%d-%d", donorId, patientId)
+}
+
+func newConnection(donor User, patient User, at time.Time) Connection {
+	c := Connection{
+		DonorId:       donor.Id,
+		PatientId:     patient.Id,
+		CreatedAt:     at,
+		DonationTypes: sharedTypes(donor, patient),
+		Compatibility: map[string]Compatibility{},
+		HLA:           matchHLA(donor.HLA, patient.HLA),
+	}
+	for _, t := range c.DonationTypes {
+		c.Compatibility[t] = typeCompatibility(t, donor, patient)
+	}
+	return c
+}
+
+//connectionsOf returns the connection records of the user with id, oldest first
+func (hs *Hospital) connectionsOf(id int) []Connection {
+	list := []Connection{}
+	for _, c := range hs.Connections {
+		if c.DonorId == id || c.PatientId == id {
+			list = append(list, c)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if !list[i].CreatedAt.Equal(list[j].CreatedAt) {
+			return list[i].CreatedAt.Before(list[j].CreatedAt)
+		}
+		return connectionKey(list[i].DonorId, list[i].PatientId) < connectionKey(list[j].DonorId, list[j].PatientId)
+	})
+	return list
+}
+
+// GET /user/{id}/connections
+func (h *usersHandler) getConnections(w http.ResponseWriter, r *http.Request, t string) {
+	userId, err := strconv.Atoi(t)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("err: invalid User id. Check Input UserId")))
+		return
+	}
+
+	if _, err := h.store.GetUser(userId); err != nil {
+		writeStoreError(w, err, "UserId")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, h.store.Connections(userId))
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+//DonationType is something a donor can give and a patient can need
+type DonationType struct {
+	Id       string `json:"id"`
+	Name     string `json:"name"`
+	Category string `json:"category"` //blood_component, organ, marrow or cord_blood
+	//Component decides blood group compatibility, empty when blood group does not restrict it
+	Component Component `json:"component,omitempty"`
+	//profile fields a donor offering, or a patient needing, this type must have on record
+	DonorAttributes   []string `json:"donor_attributes"`
+	PatientAttributes []string `json:"patient_attributes"`
+}
+
+//donationTypes is the catalogue, served at GET /users/donation-types
+var donationTypes = []DonationType{
+	{"whole_blood", "Whole blood", "blood_component", RedCells, []string{"blood_group", "date_of_birth", "weight_kg"}, []string{"blood_group"}},
+	{"red_cells", "Red blood cells", "blood_component", RedCells, []string{"blood_group", "date_of_birth", "weight_kg"}, []string{"blood_group"}},
+	{"platelets", "Platelets", "blood_component", Platelets, []string{"blood_group", "date_of_birth", "weight_kg"}, []string{"blood_group"}},
+	{"plasma", "Plasma", "blood_component", Plasma, []string{"blood_group", "date_of_birth", "weight_kg"}, []string{"blood_group"}},
+	{"kidney", "Kidney", "organ", Organ, []string{"blood_group", "date_of_birth", "weight_kg"}, []string{"blood_group"}},
+	{"liver", "Liver (partial)", "organ", Organ, []string{"blood_group", "date_of_birth", "weight_kg"}, []string{"blood_group"}},
+	{"bone_marrow", "Bone marrow / stem cells", "marrow", "", []string{"date_of_birth", "hla"}, []string{"hla"}},
+	{"cord_blood", "Umbilical cord blood", "cord_blood", "", []string{}, []string{"hla"}},
+}
+
+//defaultDonationType is what users that never picked a type give or need
+const defaultDonationType = "whole_blood"
+
+func donationType(id string) (DonationType, bool) {
+	for _, t := range donationTypes {
+		if t.Id == id {
+			return t, true
+		}
+	}
+	return DonationType{}, false
+}
+
+//donationTypesOf returns the types user offers as a donor or needs as a patient
+func donationTypesOf(user User) []string {
+	types := user.NeededTypes
+	if user.Type == Donor {
+		types = user.OfferedTypes
+	}
+	if len(types) == 0 {
+		return []string{defaultDonationType}
+	}
+	return types
+}
+
+//sharedTypes are the types donor offers that patient needs, in catalogue order
+func sharedTypes(donor User, patient User) []string {
+	offered := donationTypesOf(donor)
+	needed := donationTypesOf(patient)
+	shared := []string{}
+	for _, t := range donationTypes {
+		if contains(offered, t.Id) && contains(needed, t.Id) {
+			shared = append(shared, t.Id)
+		}
+	}
+	return shared
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+//hasAttribute reports whether the profile field attr of user is on record
+func hasAttribute(user User, attr string) bool {
+	switch attr {
+	case "blood_group":
+		return user.BloodGroup != ""
+	case "date_of_birth":
+		return user.DateOfBirth != ""
+	case "weight_kg":
+		return user.WeightKg != 0
+	case "location":
+		return user.Location != nil
+	case "hla":
+		return user.HLA.typed()
+	}
+	return false
+}
+
+//bloodComponents reports whether any of the donation types is a blood component
+func bloodComponents(types []string) bool {
+	for _, id := range types {
+		if t, ok := donationType(id); ok && t.Category == "blood_component" {
+			return true
+		}
+	}
+	return false
+}
+
+//validateDonationTypes checks that user lists only known types, without
+//repeats, and has every attribute the types it gives or needs, the default
+//one included, require on record
+func validateDonationTypes(user User) error {
+	field, types := "needed_types", user.NeededTypes
+	if user.Type == Donor {
+		field, types = "offered_types", user.OfferedTypes
+	}
+	seen := map[string]bool{}
+	for _, id := range types {
+		if _, ok := donationType(id); !ok {
+			ids := make([]string, 0, len(donationTypes))
+			for _, t := range donationTypes {
+				ids = append(ids, t.Id)
+			}
+			return fmt.Errorf("err: unknown donation type %q in %s. one of %v", id, field, ids)
+		}
+		if seen[id] {
+			return fmt.Errorf("err: donation type %q is listed twice in %s", id, field)
+		}
+		seen[id] = true
+	}
+
+	for _, id := range donationTypesOf(user) {
+		t, _ := donationType(id)
+		required := t.PatientAttributes
+		if user.Type == Donor {
+			required = t.DonorAttributes
+		}
+		for _, attr := range required {
+			if !hasAttribute(user, attr) {
+				return fmt.Errorf("err: %s requires %s on record", t.Name, attr)
+			}
+		}
+	}
+	return nil
+}
+
+//typeCompatibility is the blood group compatibility of donor for patient for
+//the donation type with id
+func typeCompatibility(id string, donor User, patient User) Compatibility {
+	t, _ := donationType(id)
+	if t.Component == "" {
+		return Compatible
+	}
+	return compatibility(t.Component, donor.BloodGroup, patient.BloodGroup)
+}
+
+//bestCompatibility is the best blood group compatibility of donor for patient
+//over types, and the type it is reached for
+func bestCompatibility(types []string, donor User, patient User) (Compatibility, string) {
+	rank := map[Compatibility]int{Compatible: 3, Caution: 2, Unknown: 1, Incompatible: 0}
+	best, bestType := Incompatible, ""
+	for _, id := range types {
+		c := typeCompatibility(id, donor, patient)
+		if bestType == "" || rank[c] > rank[best] {
+			best, bestType = c, id
+		}
+	}
+	return best, bestType
+}
+
+//checkTypes rejects a donor and patient that have no donation type in common
+func checkTypes(donor User, patient User) ([]string, error) {
+	shared := sharedTypes(donor, patient)
+	if len(shared) == 0 {
+		return nil, &httpError{http.StatusUnprocessableEntity, fmt.Sprintf("err: no donation type in common. donorId: %d offers %s, patientId: %d needs %s",
+			donor.Id, strings.Join(donationTypesOf(donor), ", "), patient.Id, strings.Join(donationTypesOf(patient), ", "))}
+	}
+	return shared, nil
+}
+
+// GET /users/donation-types
+func (h *usersHandler) getDonationTypes(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, donationTypes)
+}
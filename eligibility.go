@@ -0,0 +1,277 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+//kinds of donation, each followed by its own deferral interval
+const (
+	WholeBlood     = "whole_blood"
+	PlateletsKind  = "platelets"
+	PlasmaKind     = "plasma"
+	DoubleRedCells = "double_red_cells"
+)
+
+//Deferral keeps a donor from donating, until a date or, without one, for good
+type Deferral struct {
+	Reason string `json:"reason"`
+	Until  string `json:"until,omitempty"` //YYYY-MM-DD
+}
+
+//eligibilityRules decide who may donate. they are loaded from
+//-eligibility-rules, zero limits are not checked
+type eligibilityRules struct {
+	MinAgeYears int     `json:"min_age_years"`
+	MaxAgeYears int     `json:"max_age_years"`
+	MinWeightKg float64 `json:"min_weight_kg"`
+	//days to wait after a donation of each kind before donating again
+	IntervalDays map[string]int `json:"interval_days"`
+}
+
+func defaultEligibilityRules() eligibilityRules {
+	return eligibilityRules{
+		MinAgeYears: 17,
+		MinWeightKg: 50,
+		IntervalDays: map[string]int{
+			WholeBlood:     56,
+			PlateletsKind:  7,
+			PlasmaKind:     28,
+			DoubleRedCells: 112,
+		},
+	}
+}
+
+//loadEligibilityRules reads rules from path. kinds it leaves out keep their default interval
+func loadEligibilityRules(path string) (eligibilityRules, error) {
+	rules := defaultEligibilityRules()
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return rules, err
+	}
+	intervals := rules.IntervalDays
+	rules.IntervalDays = nil
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return rules, fmt.Errorf("eligibility rules %s: %v", path, err)
+	}
+	for kind, days := range rules.IntervalDays {
+		if days < 0 {
+			return rules, fmt.Errorf("eligibility rules %s: negative interval for %s", path, kind)
+		}
+		intervals[kind] = days
+	}
+	rules.IntervalDays = intervals
+	return rules, nil
+}
+
+//validDonationKind reports whether the rules know kind
+func (rules eligibilityRules) validDonationKind(kind string) bool {
+	_, ok := rules.IntervalDays[kind]
+	return ok
+}
+
+//Eligibility is whether a donor may donate now and if not, why and from when
+type Eligibility struct {
+	Eligible bool `json:"eligible"`
+	//NextEligible is empty when the donor is eligible or never will be again
+	NextEligible string   `json:"next_eligible,omitempty"`
+	Reasons      []string `json:"reasons,omitempty"`
+	//Missing lists profile fields the rules could not check
+	Missing []string `json:"missing,omitempty"`
+}
+
+//check applies the rules to donor giving any of types on the day of now.
+//age, weight and the interval since the last donation are whole blood rules
+//and only bind blood components, deferrals bind every type
+func (rules eligibilityRules) check(donor User, types []string, now time.Time) Eligibility {
+	today := now.UTC().Truncate(24 * time.Hour)
+	e := Eligibility{Eligible: true}
+	var next time.Time
+	permanent := false
+
+	block := func(until time.Time, reason string) {
+		e.Eligible = false
+		e.Reasons = append(e.Reasons, reason)
+		if until.IsZero() {
+			permanent = true
+		} else if until.After(next) {
+			next = until
+		}
+	}
+
+	if bloodComponents(types) {
+		if dob, err := time.Parse(dateLayout, donor.DateOfBirth); err != nil {
+			e.Missing = append(e.Missing, "date_of_birth")
+		} else {
+			if rules.MinAgeYears > 0 {
+				if from := dob.AddDate(rules.MinAgeYears, 0, 0); from.After(today) {
+					block(from, fmt.Sprintf("younger than %d", rules.MinAgeYears))
+				}
+			}
+			if rules.MaxAgeYears > 0 && !dob.AddDate(rules.MaxAgeYears+1, 0, 0).After(today) {
+				block(time.Time{}, fmt.Sprintf("older than %d", rules.MaxAgeYears))
+			}
+		}
+
+		if donor.WeightKg == 0 {
+			e.Missing = append(e.Missing, "weight_kg")
+		} else if donor.WeightKg < rules.MinWeightKg {
+			//weight can change, but there is no date to wait for
+			block(time.Time{}, fmt.Sprintf("weighs less than %gkg", rules.MinWeightKg))
+		}
+
+		if last, err := time.Parse(dateLayout, donor.LastDonation); err == nil {
+			kind := donor.LastDonationKind
+			if kind == "" {
+				kind = WholeBlood
+			}
+			if from := last.AddDate(0, 0, rules.IntervalDays[kind]); from.After(today) {
+				block(from, fmt.Sprintf("donated %s on %s", kind, donor.LastDonation))
+			}
+		}
+	}
+
+	for _, d := range donor.Deferrals {
+		if d.Until == "" {
+			block(time.Time{}, "deferred: "+d.Reason)
+			continue
+		}
+		if until, err := time.Parse(dateLayout, d.Until); err == nil && until.After(today) {
+			block(until, "deferred: "+d.Reason)
+		}
+	}
+
+	if !e.Eligible && !permanent {
+		e.NextEligible = next.Format(dateLayout)
+	}
+	return e
+}
+
+//checkEligible rejects a request or connection involving a donor the rules
+//do not let donate now
+func (h *usersHandler) checkEligible(a User, b User) error {
+	donor, patient := donorAndPatient(a, b)
+	e := h.rules.check(donor, sharedTypes(donor, patient), time.Now())
+	if e.Eligible {
+		return nil
+	}
+	msg := fmt.Sprintf("err: donorId: %d is not eligible to donate: %s", donor.Id, strings.Join(e.Reasons, "; "))
+	if e.NextEligible != "" {
+		msg += ". eligible again on " + e.NextEligible
+	}
+	return &httpError{http.StatusUnprocessableEntity, msg}
+}
+
+//publicUser is a donor or patient as other users see it in listings and
+//matches: no contact details, medical record, relationships or counters, and
+//the location only to publicLocationDeg
+type publicUser struct {
+	Id          int          `json:"id"`
+	Name        string       `json:"name"`
+	BloodGroup  BloodGroup   `json:"blood_group,omitempty"`
+	Location    *Location    `json:"location,omitempty"`
+	Eligibility *Eligibility `json:"eligibility,omitempty"` //donors only
+}
+
+//publicView is user as other users see it. e is the eligibility of a donor,
+//of which only whether and from when it can donate is shown, nil for patients
+func publicView(user User, e *Eligibility) publicUser {
+	view := publicUser{
+		Id:         user.Id,
+		Name:       user.Name,
+		BloodGroup: user.BloodGroup,
+		Location:   publicLocation(user.Location),
+	}
+	if e != nil {
+		view.Eligibility = &Eligibility{Eligible: e.Eligible, NextEligible: e.NextEligible}
+	}
+	return view
+}
+
+//listDonor is donor as listed to other users, with its eligibility
+func (h *usersHandler) listDonor(donor User, now time.Time) publicUser {
+	e := h.rules.check(donor, donationTypesOf(donor), now)
+	return publicView(donor, &e)
+}
+
+func (h *usersHandler) listDonors(donors []User) []publicUser {
+	now := time.Now()
+	list := make([]publicUser, 0, len(donors))
+	for _, donor := range donors {
+		list = append(list, h.listDonor(donor, now))
+	}
+	return list
+}
+
+func listPatients(patients []User) []publicUser {
+	list := make([]publicUser, 0, len(patients))
+	for _, patient := range patients {
+		list = append(list, publicView(patient, nil))
+	}
+	return list
+}
+
+//parseDate reads a YYYY-MM-DD date that must not be in the future
+func parseDate(field string, s string) (time.Time, error) {
+	date, err := time.Parse(dateLayout, s)
+	if err != nil || date.After(time.Now()) {
+		return date, fmt.Errorf("err: %s must be a past date like 2006-01-02", field)
+	}
+	return date, nil
+}
+
+//validateDonorProfile checks the donor fields of a user signing up. which of
+//them donors must give depends on the types they offer, see
+//validateDonationTypes. patients have no donor fields
+func (h *usersHandler) validateDonorProfile(user *User) error {
+	if user.Type != Donor {
+		user.Unavailable = false
+		user.DateOfBirth = ""
+		user.WeightKg = 0
+		user.LastDonation = ""
+		user.LastDonationKind = ""
+		user.Deferrals = nil
+		return nil
+	}
+	return h.validateDonorUpdate(*user, &user.Deferrals)
+}
+
+//validateDonorUpdate checks the donor fields set in update
+func (h *usersHandler) validateDonorUpdate(update User, deferrals *[]Deferral) error {
+	if update.DateOfBirth != "" {
+		if _, err := parseDate("date_of_birth", update.DateOfBirth); err != nil {
+			return err
+		}
+	}
+	if update.WeightKg < 0 || update.WeightKg > 500 {
+		return fmt.Errorf("err: weight_kg must be between 0 and 500")
+	}
+	if update.LastDonation != "" {
+		if _, err := parseDate("last_donation", update.LastDonation); err != nil {
+			return err
+		}
+	}
+	if update.LastDonationKind != "" {
+		if update.LastDonation == "" {
+			return fmt.Errorf("err: last_donation_kind is given together with last_donation")
+		}
+		if !h.rules.validDonationKind(update.LastDonationKind) {
+			return fmt.Errorf("err: unknown last_donation_kind %q", update.LastDonationKind)
+		}
+	}
+	if deferrals != nil {
+		for _, d := range *deferrals {
+			if d.Reason == "" {
+				return fmt.Errorf("err: every deferral needs a reason")
+			}
+			if _, err := time.Parse(dateLayout, d.Until); d.Until != "" && err != nil {
+				return fmt.Errorf("err: deferral until must be a date like 2006-01-02")
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+)
+
+//invariants checked by fsck
+const (
+	InvTotals            = "totals"
+	InvUserRecord        = "user_record"
+	InvUserInBothMaps    = "user_in_both_maps"
+	InvCredentialMapping = "credential_mapping"
+	InvOrphanCredential  = "orphan_credential"
+	InvMissingCredential = "missing_credential"
+	InvEdgeEnds          = "edge_ends"
+	InvRequestRecords    = "request_records"
+	InvConnectionRecords = "connection_records"
+)
+
+//Violation is one broken invariant of the store
+type Violation struct {
+	Invariant string `json:"invariant"`
+	Ids       []int  `json:"ids"`
+	Detail    string `json:"detail"`
+	//Repair says what a repair does about it, or how to fix it by hand when a
+	//repair can not
+	Repair     string `json:"repair"`
+	Repairable bool   `json:"repairable"`
+}
+
+//FsckReport is the outcome of checking, and maybe repairing, the store
+type FsckReport struct {
+	Seq        uint64      `json:"seq"`
+	Checked    int         `json:"checked_users"`
+	Violations []Violation `json:"violations"`
+	Repaired   bool        `json:"repaired"`
+	Remaining  []Violation `json:"remaining,omitempty"` //violations left after a repair
+}
+
+//fsck checks the invariants of hs without changing it. it returns every
+//violation found and the events that repair those that can be repaired
+func (hs *Hospital) fsck() ([]Violation, []Event) {
+	violations := []Violation{}
+	report := func(inv string, ids []int, repairable bool, repair string, format string, args ...interface{}) {
+		violations = append(violations, Violation{Invariant: inv, Ids: ids, Detail: fmt.Sprintf(format, args...), Repair: repair, Repairable: repairable})
+	}
+
+	//users are fixed on copies, which become the post-images of the repair
+	fixed := map[int]User{}
+	user := func(id int) (User, bool) {
+		if u, ok := fixed[id]; ok {
+			return u, true
+		}
+		if u, ok := hs.Patients[id]; ok {
+			return u, true
+		}
+		u, ok := hs.Donors[id]
+		return u, ok
+	}
+	fix := func(u User) {
+		if _, ok := fixed[u.Id]; !ok {
+			u = cloneUser(u)
+		}
+		fixed[u.Id] = u
+	}
+
+	ids := []int{}
+	for id := range hs.Patients {
+		ids = append(ids, id)
+	}
+	for id := range hs.Donors {
+		if _, ok := hs.Patients[id]; ok {
+			report(InvUserInBothMaps, []int{id}, false, "remove one of the two records by hand", "userId: %d is both a patient and a donor", id)
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	//records are stored under their own id and in the map of their type
+	for _, id := range ids {
+		u, _ := user(id)
+		want := Patient
+		if _, ok := hs.Donors[id]; ok {
+			want = Donor
+		}
+		if u.Id != id || u.Type != want {
+			report(InvUserRecord, []int{id}, true, "set the id and type from the map the record is stored in",
+				"userId: %d is stored as a %s but its record says id %d, type %s", id, typeName(want), u.Id, typeName(u.Type))
+			u = cloneUser(u)
+			u.Id, u.Type = id, want
+			fix(u)
+		}
+	}
+	counterpart := func(of User, id int) (User, bool) {
+		c, ok := user(id)
+		if !ok || c.Type == of.Type {
+			return User{}, false
+		}
+		return c, true
+	}
+
+	//edges join existing users, of opposite types unless one blocks the other
+	var linked, unlinked []Edge
+	edges := hs.Graph.edges()
+	for _, e := range edges {
+		from, ok := user(e.From)
+		_, ok2 := user(e.To)
+		if ok && ok2 && e.State != EdgeBlocked {
+			_, ok2 = counterpart(from, e.To)
+		}
+		if !ok || !ok2 {
+			report(InvEdgeEnds, []int{e.From, e.To}, true, "drop the edge", "%s edge from userId: %d to userId: %d does not join a patient and a donor", e.State, e.From, e.To)
+			unlinked = append(unlinked, e)
+		}
+	}
+	dropped := func(state string, from int, to int) bool {
+		from, to = normalize(state, from, to)
+		for _, e := range unlinked {
+			if e.State == state && e.From == from && e.To == to {
+				return true
+			}
+		}
+		return false
+	}
+
+	//requests: the pending records point at existing users of opposite types
+	//and each has the requested edge, which no other request has
+	var cancelled []Request
+	requestIds := make([]int, 0, len(hs.Requests))
+	for id := range hs.Requests {
+		requestIds = append(requestIds, id)
+	}
+	sort.Ints(requestIds)
+	for _, rid := range requestIds {
+		r := hs.Requests[rid]
+		if r.State != RequestPending {
+			continue
+		}
+		sender, ok := user(r.SenderId)
+		if _, ok2 := counterpart(sender, r.RecipientId); !ok || !ok2 {
+			report(InvRequestRecords, []int{r.SenderId, r.RecipientId}, true, "cancel the request",
+				"pending request %d from userId: %d to userId: %d does not join a patient and a donor", r.Id, r.SenderId, r.RecipientId)
+			r.State = RequestCancelled
+			cancelled = append(cancelled, r)
+			continue
+		}
+		if e, ok := hs.Graph.edge(EdgeRequested, r.SenderId, r.RecipientId); !ok || e.RequestId != r.Id {
+			report(InvRequestRecords, []int{r.SenderId, r.RecipientId}, true, "cancel the request",
+				"pending request %d from userId: %d to userId: %d has no requested edge", r.Id, r.SenderId, r.RecipientId)
+			r.State = RequestCancelled
+			cancelled = append(cancelled, r)
+		}
+	}
+	for _, e := range edges {
+		if e.State != EdgeRequested || dropped(e.State, e.From, e.To) {
+			continue
+		}
+		if r, ok := hs.Requests[e.RequestId]; !ok || r.State != RequestPending || r.SenderId != e.From || r.RecipientId != e.To {
+			report(InvRequestRecords, []int{e.From, e.To}, true, "drop the edge", "requested edge from userId: %d to userId: %d has no pending request %d", e.From, e.To, e.RequestId)
+			unlinked = append(unlinked, e)
+		}
+	}
+
+	//a connected edge and its record go together
+	keys := make([]string, 0, len(hs.Connections))
+	for key := range hs.Connections {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		c := hs.Connections[key]
+		if dropped(EdgeConnected, c.DonorId, c.PatientId) {
+			//goes with the edge
+			continue
+		}
+		if !hs.Graph.has(EdgeConnected, c.DonorId, c.PatientId) {
+			report(InvConnectionRecords, []int{c.DonorId, c.PatientId}, true, "drop the record", "connection record %s has no connection behind it", key)
+			unlinked = append(unlinked, Edge{From: c.DonorId, To: c.PatientId, State: EdgeConnected})
+		}
+	}
+	for _, e := range edges {
+		if e.State != EdgeConnected || dropped(e.State, e.From, e.To) {
+			continue
+		}
+		donor, patient := e.From, e.To
+		if _, ok := hs.Donors[donor]; !ok {
+			donor, patient = patient, donor
+		}
+		if _, ok := hs.Connections[connectionKey(donor, patient)]; !ok {
+			report(InvConnectionRecords, []int{donor, patient}, true, "create the record", "donorId: %d and patientId: %d are connected without a record", donor, patient)
+			linked = append(linked, e)
+		}
+	}
+
+	//both credential maps mirror each other and point at existing users or staff
+	exists := func(id int) bool {
+		if _, ok := user(id); ok {
+			return true
+		}
+		_, ok := hs.Staff[id]
+		return ok
+	}
+	var deleted []int
+	var revoked []string
+	mappedIds := make([]int, 0, len(hs.IdsToSelectors))
+	for id := range hs.IdsToSelectors {
+		mappedIds = append(mappedIds, id)
+	}
+	sort.Ints(mappedIds)
+	for _, id := range mappedIds {
+		selector := hs.IdsToSelectors[id]
+		config, ok := hs.Credentials[selector]
+		switch {
+		case !exists(id):
+			report(InvCredentialMapping, []int{id}, true, "drop the secret code of the missing user", "userId: %d has a secret code but no record", id)
+			deleted = append(deleted, id)
+		case !ok:
+			report(InvCredentialMapping, []int{id}, false, fmt.Sprintf("issue a new code with POST /admin/users/%d/repair", id), "userId: %d maps to a secret code that does not exist", id)
+		case config.Id != id:
+			report(InvCredentialMapping, []int{id, config.Id}, false, fmt.Sprintf("issue a new code with POST /admin/users/%d/repair", id), "userId: %d maps to the secret code of userId: %d", id, config.Id)
+		}
+	}
+	selectors := make([]string, 0, len(hs.Credentials))
+	for selector := range hs.Credentials {
+		selectors = append(selectors, selector)
+	}
+	sort.Strings(selectors)
+	for _, selector := range selectors {
+		config := hs.Credentials[selector]
+		if hs.IdsToSelectors[config.Id] == selector {
+			continue
+		}
+		if exists(config.Id) && hs.Credentials[hs.IdsToSelectors[config.Id]].Id != config.Id {
+			//the only code of the user, dropping it would leave nothing to repair from
+			report(InvOrphanCredential, []int{config.Id}, false, fmt.Sprintf("issue a new code with POST /admin/users/%d/repair", config.Id), "a secret code of userId: %d is not mapped to it", config.Id)
+			continue
+		}
+		report(InvOrphanCredential, []int{config.Id}, true, "drop the unmapped secret code", "a secret code of userId: %d is not mapped to it", config.Id)
+		revoked = append(revoked, selector)
+	}
+	for _, id := range ids {
+		if _, ok := hs.IdsToSelectors[id]; !ok {
+			report(InvMissingCredential, []int{id}, false, fmt.Sprintf("issue a new code with POST /admin/users/%d/repair", id), "userId: %d has no secret code", id)
+		}
+	}
+
+	//counters
+	recount := false
+	if hs.TotalPatients != len(hs.Patients) || hs.TotalDonors != len(hs.Donors) || hs.Total != hs.TotalPatients+hs.TotalDonors {
+		report(InvTotals, []int{}, true, "recount from the stored users",
+			"total %d, patients %d, donors %d but %d patients and %d donors are stored", hs.Total, hs.TotalPatients, hs.TotalDonors, len(hs.Patients), len(hs.Donors))
+		recount = true
+	}
+
+	var events []Event
+	if len(fixed) > 0 || len(cancelled) > 0 || len(linked) > 0 || len(unlinked) > 0 || len(revoked) > 0 {
+		users := make([]User, 0, len(fixed))
+		for _, u := range fixed {
+			users = append(users, u)
+		}
+		sort.Slice(users, func(i, j int) bool {
+			return users[i].Id < users[j].Id
+		})
+		events = append(events, Event{Type: EventFsckRepair, Users: users, Requests: cancelled, Linked: linked, Unlinked: unlinked, RevokedSelectors: revoked})
+	}
+	//deletes go in their own event, so nobody is notified about them
+	if len(deleted) > 0 {
+		events = append(events, Event{Type: EventFsckRepair, Deleted: deleted})
+	}
+	if recount {
+		if len(events) == 0 {
+			events = append(events, Event{Type: EventFsckRepair})
+		}
+		events[len(events)-1].Recount = true
+	}
+	return violations, events
+}
+
+//recount sets the totals from the stored users
+func (hs *Hospital) recount() {
+	hs.TotalPatients = len(hs.Patients)
+	hs.TotalDonors = len(hs.Donors)
+	hs.Total = hs.TotalPatients + hs.TotalDonors
+}
+
+// GET /admin/fsck
+// POST /admin/fsck/repair
+func (h *usersHandler) fsck(repair bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		report, err := h.store.Fsck(audited(r), repair)
+		if err != nil {
+			writeStoreError(w, err, "UserId")
+			return
+		}
+		writeJSON(w, http.StatusOK, report)
+	}
+}
+
+//runFsck is the fsck subcommand: it checks the store at -data and, with
+//-repair, journals the repairs. without -repair the files are not touched.
+//it refuses to run while a server has the store open, GET /admin/fsck checks
+//a running one. the exit code is 1 when violations are left
+func runFsck(args []string) int {
+	flags := flag.NewFlagSet("fsck", flag.ExitOnError)
+	dataFile := flags.String("data", "hospital.json", "path of the hospital snapshot file")
+	repair := flags.Bool("repair", false, "repair what can be repaired and journal it")
+	flags.Parse(args)
+
+	store, err := openFileStore(*dataFile, 0, !*repair)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "fsck:", err)
+		return 2
+	}
+	report, err := store.Fsck(nil, *repair)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "fsck:", err)
+		return 2
+	}
+
+	out, _ := json.MarshalIndent(report, "", "  ")
+	fmt.Println(string(out))
+	if len(report.Violations) > 0 && (!report.Repaired || len(report.Remaining) > 0) {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const earthRadiusKm = 6371.0
+
+var ErrNotGeocoded = errors.New("address could not be geocoded")
+
+//Location is a point in decimal degrees
+type Location struct {
+	Lat float64 `json:"lat"`
+	Lng float64 `json:"lng"`
+}
+
+func (l Location) valid() bool {
+	return l.Lat >= -90 && l.Lat <= 90 && l.Lng >= -180 && l.Lng <= 180
+}
+
+//parseLocation reads "lat,lng"
+func parseLocation(s string) (Location, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 2 {
+		return Location{}, fmt.Errorf("err: location must be lat,lng")
+	}
+	lat, err1 := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+	lng, err2 := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+	loc := Location{Lat: lat, Lng: lng}
+	if err1 != nil || err2 != nil || !loc.valid() {
+		return Location{}, fmt.Errorf("err: location must be lat,lng in decimal degrees")
+	}
+	return loc, nil
+}
+
+//greatCircleKm is the haversine distance between a and b
+func greatCircleKm(a Location, b Location) float64 {
+	rad := math.Pi / 180
+	dLat := (b.Lat - a.Lat) * rad
+	dLng := (b.Lng - a.Lng) * rad
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(a.Lat*rad)*math.Cos(b.Lat*rad)*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return 2 * earthRadiusKm * math.Asin(math.Min(1, math.Sqrt(h)))
+}
+
+//publicLocationDeg is the grid, in degrees, locations are snapped to before
+//other users see them, about 11km. distances shown to users are measured
+//from the snapped location too, or a few searches would narrow it down
+const publicLocationDeg = 0.1
+
+//publicSlackKm is the furthest a location can be from its snapped one
+const publicSlackKm = 8
+
+//publicLocation snaps l to the publicLocationDeg grid, nil when l is
+func publicLocation(l *Location) *Location {
+	if l == nil {
+		return nil
+	}
+	snap := func(deg float64) float64 {
+		//divided rather than multiplied, so 10.3 is not written as 10.300000000000001
+		return math.Round(deg/publicLocationDeg) / (1 / publicLocationDeg)
+	}
+	return &Location{Lat: snap(l.Lat), Lng: snap(l.Lng)}
+}
+
+//distanceKm between two users, false when either has no location on record
+func distanceKm(a User, b User) (float64, bool) {
+	if a.Location == nil || b.Location == nil {
+		return 0, false
+	}
+	return greatCircleKm(*a.Location, *b.Location), true
+}
+
+//Geocoder resolves an address to a location. implementations must work
+//offline, addresses are never sent to a third party
+type Geocoder interface {
+	Geocode(address string) (Location, error)
+}
+
+//tableGeocoder looks addresses up in a table loaded from a json file of
+//{"address": {"lat": ..., "lng": ...}}. case and spacing of addresses are ignored
+type tableGeocoder map[string]Location
+
+func normalizeAddress(address string) string {
+	return strings.ToLower(strings.Join(strings.Fields(address), " "))
+}
+
+func loadTableGeocoder(path string) (tableGeocoder, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var raw map[string]Location
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("geocode table %s: %v", path, err)
+	}
+	table := tableGeocoder{}
+	for address, loc := range raw {
+		if !loc.valid() {
+			return nil, fmt.Errorf("geocode table %s: invalid location for %q", path, address)
+		}
+		table[normalizeAddress(address)] = loc
+	}
+	return table, nil
+}
+
+func (t tableGeocoder) Geocode(address string) (Location, error) {
+	loc, ok := t[normalizeAddress(address)]
+	if !ok {
+		return Location{}, ErrNotGeocoded
+	}
+	return loc, nil
+}
+
+//geocode resolves address with the configured geocoder, nil if there is none
+//or it does not know the address
+func (h *usersHandler) geocode(address string) *Location {
+	if h.geocoder == nil {
+		return nil
+	}
+	loc, err := h.geocoder.Geocode(address)
+	if err != nil {
+		return nil
+	}
+	return &loc
+}
+
+//maxNearRadiusKm bounds a donor search, so it never walks the whole grid
+const maxNearRadiusKm = 500
+
+//geoCellDeg is the size of a geoIndex cell, about 111km north to south
+const geoCellDeg = 1.0
+
+type geoCell struct {
+	Lat int
+	Lng int
+}
+
+func cellOf(loc Location) geoCell {
+	return geoCell{
+		Lat: int(math.Floor(loc.Lat / geoCellDeg)),
+		Lng: wrapLngCell(int(math.Floor(loc.Lng / geoCellDeg))),
+	}
+}
+
+//wrapLngCell maps a longitude cell past the antimeridian back into range
+func wrapLngCell(lng int) int {
+	n := int(360 / geoCellDeg)
+	return ((lng+n/2)%n+n)%n - n/2
+}
+
+//geoIndex buckets user locations into a grid of geoCellDeg cells so a radius
+//search only looks at the cells the radius overlaps
+type geoIndex struct {
+	cells map[geoCell]map[int]Location
+	users map[int]geoCell
+}
+
+func newGeoIndex() *geoIndex {
+	return &geoIndex{
+		cells: map[geoCell]map[int]Location{},
+		users: map[int]geoCell{},
+	}
+}
+
+//put indexes user, or drops it if it has no location
+func (g *geoIndex) put(user User) {
+	g.remove(user.Id)
+	if user.Location == nil {
+		return
+	}
+	cell := cellOf(*user.Location)
+	if g.cells[cell] == nil {
+		g.cells[cell] = map[int]Location{}
+	}
+	g.cells[cell][user.Id] = *user.Location
+	g.users[user.Id] = cell
+}
+
+func (g *geoIndex) remove(id int) {
+	cell, ok := g.users[id]
+	if !ok {
+		return
+	}
+	delete(g.cells[cell], id)
+	if len(g.cells[cell]) == 0 {
+		delete(g.cells, cell)
+	}
+	delete(g.users, id)
+}
+
+//geoHit is a user found by a radius search
+type geoHit struct {
+	Id         int
+	DistanceKm float64
+}
+
+//near returns the users within radiusKm of center, nearest first
+func (g *geoIndex) near(center Location, radiusKm float64) []geoHit {
+	latSpan := radiusKm / (earthRadiusKm * math.Pi / 180)
+	minLat := int(math.Floor(math.Max(-90, center.Lat-latSpan) / geoCellDeg))
+	maxLat := int(math.Floor(math.Min(90, center.Lat+latSpan) / geoCellDeg))
+
+	//a degree of longitude shrinks towards the poles. close to them, or for
+	//huge radii, every longitude is in range, and each cell is visited once
+	lngCells := int(360 / geoCellDeg)
+	minLng, maxLng := -lngCells/2, lngCells/2-1
+	maxAbsLat := math.Min(90, math.Max(math.Abs(center.Lat-latSpan), math.Abs(center.Lat+latSpan)))
+	if maxAbsLat < 89 {
+		lngSpan := latSpan / math.Cos(maxAbsLat*math.Pi/180)
+		from := int(math.Floor((center.Lng - lngSpan) / geoCellDeg))
+		to := int(math.Floor((center.Lng + lngSpan) / geoCellDeg))
+		if to-from < lngCells {
+			minLng, maxLng = from, to
+		}
+	}
+
+	hits := []geoHit{}
+	for lat := minLat; lat <= maxLat; lat++ {
+		for lng := minLng; lng <= maxLng; lng++ {
+			for id, loc := range g.cells[geoCell{Lat: lat, Lng: wrapLngCell(lng)}] {
+				if d := greatCircleKm(center, loc); d <= radiusKm {
+					hits = append(hits, geoHit{Id: id, DistanceKm: d})
+				}
+			}
+		}
+	}
+
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].DistanceKm != hits[j].DistanceKm {
+			return hits[i].DistanceKm < hits[j].DistanceKm
+		}
+		return hits[i].Id < hits[j].Id
+	})
+	return hits
+}
+
+//donorNear is a donor found by a radius search
+type donorNear struct {
+	publicUser
+	DistanceKm float64 `json:"distance_km"`
+}
+
+// GET /users/donors?near=lat,lng&radius_km=
+//getDonorsNear lists the active donors within radius_km, default 50, of
+//near, nearest first. donors without a location are left out. radius and
+//distance are measured to the published location of a donor, not the exact one
+func (h *usersHandler) getDonorsNear(w http.ResponseWriter, r *http.Request) {
+	center, err := parseLocation(r.URL.Query().Get("near"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	radius := 50.0
+	if v := r.URL.Query().Get("radius_km"); v != "" {
+		radius, err = strconv.ParseFloat(v, 64)
+		if err != nil || radius <= 0 || radius > maxNearRadiusKm {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(fmt.Sprintf("err: radius_km must be above 0 and at most %d", maxNearRadiusKm)))
+			return
+		}
+	}
+
+	now := time.Now()
+	list := []donorNear{}
+	//searched wider by the snapping, so every donor published inside the radius is found
+	for _, hit := range h.store.DonorsNear(center, radius+publicSlackKm) {
+		donor, err := h.store.GetUser(hit.Id)
+		if err != nil || donor.Deactivated {
+			continue
+		}
+		listing := h.listDonor(donor, now)
+		distance := greatCircleKm(center, *listing.Location)
+		if distance > radius {
+			continue
+		}
+		list = append(list, donorNear{publicUser: listing, DistanceKm: math.Round(distance*100) / 100})
+	}
+	sort.SliceStable(list, func(i, j int) bool {
+		if list[i].DistanceKm != list[j].DistanceKm {
+			return list[i].DistanceKm < list[j].DistanceKm
+		}
+		return list[i].Id < list[j].Id
+	})
+	writeJSON(w, http.StatusOK, list)
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+)
+
+//edge states
+const (
+	EdgeConnected = "connected" //mutual, between a donor and a patient
+	EdgeRequested = "requested" //from the sender of a pending request to its recipient
+	EdgeBlocked   = "blocked"   //from a user to a user it does not accept requests from
+)
+
+//Edge is one relationship between two users. connected edges are mutual and
+//kept with From below To, the others point from From to To
+type Edge struct {
+	From      int       `json:"from"`
+	To        int       `json:"to"`
+	State     string    `json:"state"`
+	Since     time.Time `json:"since,omitempty"`      //zero for relationships made before they were dated
+	RequestId int       `json:"request_id,omitempty"` //the pending request behind a requested edge
+}
+
+//Graph holds the relationships between users as adjacency sets keyed by user
+//id, so they are looked up and changed in constant time. it is the source of
+//truth for the relationship ids of users, which are only produced from it on
+//output
+type Graph struct {
+	out map[string]map[int]map[int]Edge //map[state][from][to]
+	in  map[string]map[int]map[int]Edge //map[state][to][from]
+}
+
+func newGraph() *Graph {
+	return &Graph{
+		out: map[string]map[int]map[int]Edge{},
+		in:  map[string]map[int]map[int]Edge{},
+	}
+}
+
+func addEdge(sets map[string]map[int]map[int]Edge, state string, a int, b int, e Edge) {
+	if sets[state] == nil {
+		sets[state] = map[int]map[int]Edge{}
+	}
+	if sets[state][a] == nil {
+		sets[state][a] = map[int]Edge{}
+	}
+	sets[state][a][b] = e
+}
+
+func removeEdge(sets map[string]map[int]map[int]Edge, state string, a int, b int) {
+	delete(sets[state][a], b)
+	if len(sets[state][a]) == 0 {
+		delete(sets[state], a)
+	}
+}
+
+//normalize orders the ends of a connected edge
+func normalize(state string, from int, to int) (int, int) {
+	if state == EdgeConnected && from > to {
+		return to, from
+	}
+	return from, to
+}
+
+//edge returns the edge in state from one user to another
+func (g *Graph) edge(state string, from int, to int) (Edge, bool) {
+	e, ok := g.out[state][from][to]
+	return e, ok
+}
+
+func (g *Graph) has(state string, from int, to int) bool {
+	_, ok := g.out[state][from][to]
+	return ok
+}
+
+//put adds e, replacing the edge in its state between the same users.
+//a connected edge is added both ways
+func (g *Graph) put(e Edge) {
+	e.From, e.To = normalize(e.State, e.From, e.To)
+	addEdge(g.out, e.State, e.From, e.To, e)
+	addEdge(g.in, e.State, e.To, e.From, e)
+	if e.State == EdgeConnected {
+		addEdge(g.out, e.State, e.To, e.From, e)
+		addEdge(g.in, e.State, e.From, e.To, e)
+	}
+}
+
+//remove drops the edge in state from one user to another and returns it
+func (g *Graph) remove(state string, from int, to int) (Edge, bool) {
+	e, ok := g.edge(state, from, to)
+	if !ok {
+		return Edge{}, false
+	}
+	removeEdge(g.out, state, from, to)
+	removeEdge(g.in, state, to, from)
+	if state == EdgeConnected {
+		removeEdge(g.out, state, to, from)
+		removeEdge(g.in, state, from, to)
+	}
+	return e, true
+}
+
+//removeUser drops every edge of the user with id and returns them
+func (g *Graph) removeUser(id int) []Edge {
+	var removed []Edge
+	for _, state := range []string{EdgeConnected, EdgeRequested, EdgeBlocked} {
+		for other := range g.out[state][id] {
+			if e, ok := g.remove(state, id, other); ok {
+				removed = append(removed, e)
+			}
+		}
+		for other := range g.in[state][id] {
+			if e, ok := g.remove(state, other, id); ok {
+				removed = append(removed, e)
+			}
+		}
+	}
+	sortEdges(removed)
+	return removed
+}
+
+//from returns the ids the user with id has an edge in state to, oldest first
+func (g *Graph) from(state string, id int) []int {
+	return oldestFirst(g.out[state][id])
+}
+
+//edgesFrom returns the edges in state from the user with id, keyed by the
+//other end. the map belongs to the graph and must not be changed
+func (g *Graph) edgesFrom(state string, id int) map[int]Edge {
+	return g.out[state][id]
+}
+
+//to returns the ids that have an edge in state to the user with id, oldest first
+func (g *Graph) to(state string, id int) []int {
+	return oldestFirst(g.in[state][id])
+}
+
+func oldestFirst(set map[int]Edge) []int {
+	if len(set) == 0 {
+		return nil
+	}
+	type entry struct {
+		id    int
+		since time.Time
+	}
+	list := make([]entry, 0, len(set))
+	for id, e := range set {
+		list = append(list, entry{id, e.Since})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if !list[i].since.Equal(list[j].since) {
+			return list[i].since.Before(list[j].since)
+		}
+		return list[i].id < list[j].id
+	})
+	ids := make([]int, len(list))
+	for i, e := range list {
+		ids[i] = e.id
+	}
+	return ids
+}
+
+//edges returns every edge once, in a stable order
+func (g *Graph) edges() []Edge {
+	list := []Edge{}
+	for _, sets := range g.out {
+		for from, set := range sets {
+			for to, e := range set {
+				if e.From == from && e.To == to {
+					list = append(list, e)
+				}
+			}
+		}
+	}
+	sortEdges(list)
+	return list
+}
+
+func sortEdges(list []Edge) {
+	sort.Slice(list, func(i, j int) bool {
+		a, b := list[i], list[j]
+		if a.State != b.State {
+			return a.State < b.State
+		}
+		if a.From != b.From {
+			return a.From < b.From
+		}
+		return a.To < b.To
+	})
+}
+
+//the graph is kept in the snapshot as its list of edges
+func (g *Graph) MarshalJSON() ([]byte, error) {
+	return json.Marshal(g.edges())
+}
+
+func (g *Graph) UnmarshalJSON(data []byte) error {
+	var list []Edge
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	*g = *newGraph()
+	for _, e := range list {
+		g.put(e)
+	}
+	return nil
+}
+
+//withRelations returns a copy of user with its relationship ids produced from the graph
+func (hs *Hospital) withRelations(user User) User {
+	user.RequestedUserIds = hs.Graph.from(EdgeRequested, user.Id)
+	user.PendingUserIds = hs.Graph.to(EdgeRequested, user.Id)
+	user.ConnectedUsersIds = hs.Graph.from(EdgeConnected, user.Id)
+	user.BlockedUserIds = hs.Graph.from(EdgeBlocked, user.Id)
+	return user
+}
+
+//withoutRelations returns user without relationship ids, as it is stored
+func withoutRelations(user User) User {
+	user.RequestedUserIds = nil
+	user.PendingUserIds = nil
+	user.ConnectedUsersIds = nil
+	user.BlockedUserIds = nil
+	return user
+}
+
+//link adds e to the graph. a connected edge gets a connection record, dated
+//like the edge, if there is none
+func (hs *Hospital) link(e Edge) {
+	hs.Graph.put(e)
+	if e.State != EdgeConnected {
+		return
+	}
+	donor, ok := hs.Donors[e.From]
+	patient, ok2 := hs.Patients[e.To]
+	if !ok || !ok2 {
+		donor, ok = hs.Donors[e.To]
+		patient, ok2 = hs.Patients[e.From]
+	}
+	if !ok || !ok2 {
+		return
+	}
+	key := connectionKey(donor.Id, patient.Id)
+	if _, ok := hs.Connections[key]; !ok {
+		hs.Connections[key] = newConnection(donor, patient, e.Since)
+	}
+}
+
+//unlink drops the edge in state between two users. for a connected edge the
+//connection record goes with it, even if the edge was already gone
+func (hs *Hospital) unlink(state string, from int, to int) {
+	hs.Graph.remove(state, from, to)
+	if state == EdgeConnected {
+		delete(hs.Connections, connectionKey(from, to))
+		delete(hs.Connections, connectionKey(to, from))
+	}
+}
+
+//unlinkUser drops every edge of the user with id, with its connection records
+func (hs *Hospital) unlinkUser(id int) {
+	for _, e := range hs.Graph.removeUser(id) {
+		hs.unlink(e.State, e.From, e.To)
+	}
+}
+
+//linkRequests keeps the requested edges in line with requests: a pending
+//request has one, a request that left pending takes its edge with it
+func (hs *Hospital) linkRequests(requests []Request) {
+	for _, r := range requests {
+		if r.State == RequestPending {
+			hs.link(Edge{From: r.SenderId, To: r.RecipientId, State: EdgeRequested, Since: r.CreatedAt, RequestId: r.Id})
+			continue
+		}
+		if e, ok := hs.Graph.edge(EdgeRequested, r.SenderId, r.RecipientId); ok && e.RequestId == r.Id {
+			hs.unlink(EdgeRequested, r.SenderId, r.RecipientId)
+		}
+	}
+}
+
+//linkBook stages changes to the connected and blocked edges between the users
+//of a store update on top of the graph, like requestBook does for their
+//requests. requested edges follow the requests and are not staged here
+type linkBook struct {
+	graph  *Graph
+	staged map[Edge]bool //map[edge without metadata] = linked
+	order  []Edge
+}
+
+func (hs *Hospital) linkBook() *linkBook {
+	return &linkBook{graph: hs.Graph, staged: map[Edge]bool{}}
+}
+
+func stagedEdge(state string, from int, to int) Edge {
+	from, to = normalize(state, from, to)
+	return Edge{From: from, To: to, State: state}
+}
+
+//has reports whether there is an edge in state from one user to another, staged or not
+func (b *linkBook) has(state string, from int, to int) bool {
+	if linked, ok := b.staged[stagedEdge(state, from, to)]; ok {
+		return linked
+	}
+	return b.graph.has(state, from, to)
+}
+
+//link stages an edge in state from one user to another, reporting whether
+//there was none
+func (b *linkBook) link(state string, from int, to int) bool {
+	if b.has(state, from, to) {
+		return false
+	}
+	b.stage(stagedEdge(state, from, to), true)
+	return true
+}
+
+//unlink stages dropping the edge in state from one user to another,
+//reporting whether there was one
+func (b *linkBook) unlink(state string, from int, to int) bool {
+	if !b.has(state, from, to) {
+		return false
+	}
+	b.stage(stagedEdge(state, from, to), false)
+	return true
+}
+
+func (b *linkBook) stage(e Edge, linked bool) {
+	if _, ok := b.staged[e]; !ok {
+		b.order = append(b.order, e)
+	}
+	b.staged[e] = linked
+}
+
+//changes returns the edges staged to be added and dropped, in the order they were staged
+func (b *linkBook) changes() ([]Edge, []Edge) {
+	var linked, unlinked []Edge
+	for _, e := range b.order {
+		exists := b.graph.has(e.State, e.From, e.To)
+		switch {
+		case b.staged[e] && !exists:
+			linked = append(linked, e)
+		case !b.staged[e] && exists:
+			unlinked = append(unlinked, e)
+		}
+	}
+	return linked, unlinked
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+//relations keeps the relationship ids of users as plain lists were kept
+//before the graph, updated by hand for every change that went through
+type relations struct {
+	requested map[int]map[int]bool //map[sender][recipient]
+	connected map[int]map[int]bool
+}
+
+func (m relations) set(lists map[int]map[int]bool, a int, b int, on bool) {
+	if lists[a] == nil {
+		lists[a] = map[int]bool{}
+	}
+	if on {
+		lists[a][b] = true
+	} else {
+		delete(lists[a], b)
+	}
+}
+
+//ids returns the ids with set on in lists of id, pointing from or to id
+func (m relations) ids(lists map[int]map[int]bool, id int, to bool) []int {
+	ids := []int{}
+	for a, set := range lists {
+		for b := range set {
+			if !to && a == id {
+				ids = append(ids, b)
+			} else if to && b == id {
+				ids = append(ids, a)
+			}
+		}
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+func sortedIds(ids []int) []int {
+	sorted := append([]int{}, ids...)
+	sort.Ints(sorted)
+	return sorted
+}
+
+//checkRelations compares the relationship ids hospital produces for every
+//user in ids with the lists of m
+func checkRelations(t *testing.T, step string, hospital *Hospital, m relations, ids []int) {
+	t.Helper()
+	for _, id := range ids {
+		user, ok := hospital.Patients[id]
+		if !ok {
+			user = hospital.Donors[id]
+		}
+		user = hospital.withRelations(user)
+		got := [][]int{sortedIds(user.RequestedUserIds), sortedIds(user.PendingUserIds), sortedIds(user.ConnectedUsersIds)}
+		want := [][]int{m.ids(m.requested, id, false), m.ids(m.requested, id, true), m.ids(m.connected, id, false)}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("%s: user %d has requested, pending, connected %v, want %v", step, id, got, want)
+		}
+	}
+	//a requested edge stands for exactly one pending request
+	pending := 0
+	for _, r := range hospital.Requests {
+		if r.State != RequestPending {
+			continue
+		}
+		pending += 1
+		if e, ok := hospital.Graph.edge(EdgeRequested, r.SenderId, r.RecipientId); !ok || e.RequestId != r.Id {
+			t.Fatalf("%s: pending request %d has no edge from %d to %d", step, r.Id, r.SenderId, r.RecipientId)
+		}
+	}
+	edges := 0
+	for _, e := range hospital.Graph.edges() {
+		if e.State == EdgeRequested {
+			edges += 1
+		}
+	}
+	if edges != pending {
+		t.Fatalf("%s: %d requested edges for %d pending requests", step, edges, pending)
+	}
+}
+
+func TestGraphMatchesIdLists(t *testing.T) {
+	s := newTestServer(t)
+	ids := []int{}
+	tokens := map[int]string{}
+	for i := 0; i < 6; i++ {
+		body := testPatient
+		if i%2 == 1 {
+			body = testDonor
+		}
+		user, token := s.signup(body)
+		ids = append(ids, user.Id)
+		tokens[user.Id] = token
+	}
+
+	m := relations{requested: map[int]map[int]bool{}, connected: map[int]map[int]bool{}}
+	methods := []string{"SEND", "SEND", "ACCEPT", "DELETE", "DECLINE", "PURGE"}
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 500; i++ {
+		a, b := ids[rnd.Intn(len(ids))], ids[rnd.Intn(len(ids))]
+		method := methods[rnd.Intn(len(methods))]
+		w := s.do(method, fmt.Sprintf("/user/%d/request/%d", a, b), tokens[a], "")
+		step := fmt.Sprintf("step %d, %d %s %d: %d", i, a, method, b, w.Code)
+		if w.Code == http.StatusOK {
+			switch method {
+			case "SEND":
+				m.set(m.requested, a, b, true)
+			case "ACCEPT":
+				//a crossed request the other way is answered too
+				m.set(m.requested, b, a, false)
+				m.set(m.requested, a, b, false)
+				m.set(m.connected, a, b, true)
+				m.set(m.connected, b, a, true)
+			case "DELETE":
+				m.set(m.requested, a, b, false)
+			case "DECLINE":
+				m.set(m.requested, b, a, false)
+			case "PURGE":
+				m.set(m.connected, a, b, false)
+				m.set(m.connected, b, a, false)
+			}
+		}
+		checkRelations(t, step, &s.store.hospital, m, ids)
+	}
+
+	//the graph is all that is stored, the lists come back from it
+	data, err := json.Marshal(s.store.hospital)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hospital := emptyHospital()
+	if err := json.Unmarshal(data, &hospital); err != nil {
+		t.Fatal(err)
+	}
+	checkRelations(t, "reloaded", &hospital, m, ids)
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+//HLATyping holds up to two alleles per locus, e.g. "A*02:01". a single allele
+//means the user is homozygous at that locus
+type HLATyping struct {
+	A    []string `json:"a,omitempty"`
+	B    []string `json:"b,omitempty"`
+	C    []string `json:"c,omitempty"`
+	DRB1 []string `json:"drb1,omitempty"`
+	DQB1 []string `json:"dqb1,omitempty"`
+}
+
+//hlaLoci in the order they are counted. the first four give the 8/8 match,
+//all five the 10/10 match
+var hlaLoci = []string{"A", "B", "C", "DRB1", "DQB1"}
+
+var hlaAllele = regexp.MustCompile(`^(A|B|C|DRB1|DQB1)\*\d{2,3}(:\d{2,3}){0,3}[A-Z]?$`)
+
+func (t *HLATyping) locus(name string) *[]string {
+	switch name {
+	case "A":
+		return &t.A
+	case "B":
+		return &t.B
+	case "C":
+		return &t.C
+	case "DRB1":
+		return &t.DRB1
+	default:
+		return &t.DQB1
+	}
+}
+
+//normalize uppercases the alleles of t, prefixes them with their locus if
+//missing and checks their format
+func (t *HLATyping) normalize() error {
+	for _, name := range hlaLoci {
+		alleles := t.locus(name)
+		if len(*alleles) > 2 {
+			return fmt.Errorf("err: hla %s takes at most 2 alleles", strings.ToLower(name))
+		}
+		for i, a := range *alleles {
+			a = strings.ToUpper(strings.TrimSpace(a))
+			if !strings.Contains(a, "*") {
+				a = name + "*" + a
+			}
+			if !hlaAllele.MatchString(a) || !strings.HasPrefix(a, name+"*") {
+				return fmt.Errorf("err: invalid hla %s allele %q, expected e.g. %s*01:01", strings.ToLower(name), (*alleles)[i], name)
+			}
+			(*alleles)[i] = a
+		}
+	}
+	return nil
+}
+
+//typed reports whether t has the loci every HLA match needs: A, B and DRB1
+func (t *HLATyping) typed() bool {
+	return t != nil && len(t.A) > 0 && len(t.B) > 0 && len(t.DRB1) > 0
+}
+
+//pair returns the two alleles of a locus, doubling a homozygous one
+func pair(alleles []string) []string {
+	if len(alleles) == 1 {
+		return []string{alleles[0], alleles[0]}
+	}
+	return alleles
+}
+
+//sameAllele compares two alleles at two-field resolution. an allele typed at
+//one field only matches on that field
+func sameAllele(a string, b string) bool {
+	fa := strings.Split(a, ":")
+	fb := strings.Split(b, ":")
+	n := 2
+	if len(fa) < n || len(fb) < n {
+		n = 1
+	}
+	for i := 0; i < n; i++ {
+		if strings.TrimRight(fa[i], "ABCDEFGHIJKLMNOPQRSTUVWXYZ") != strings.TrimRight(fb[i], "ABCDEFGHIJKLMNOPQRSTUVWXYZ") {
+			return false
+		}
+	}
+	return true
+}
+
+//HLALocusMatch is how many of the patient's alleles at one locus the donor shares
+type HLALocusMatch struct {
+	Locus   string   `json:"locus"`
+	Matched int      `json:"matched"`
+	Patient []string `json:"patient"`
+	Donor   []string `json:"donor"`
+}
+
+//HLAMatch compares the HLA typing of a donor and a patient
+type HLAMatch struct {
+	Loci []HLALocusMatch `json:"loci"`
+	//Match8 and Match10 are like "7/8", empty when a locus they count is untyped
+	Match8     string   `json:"match_8,omitempty"`
+	Match10    string   `json:"match_10,omitempty"`
+	Matched    int      `json:"matched"`
+	Of         int      `json:"of"`                   //alleles compared, 2 per locus typed on both sides
+	Mismatches []string `json:"mismatches,omitempty"` //one entry per mismatched locus
+	Untyped    []string `json:"untyped,omitempty"`    //loci missing on either side
+}
+
+//matchHLA compares donor and patient, nil unless both are typed
+func matchHLA(donor *HLATyping, patient *HLATyping) *HLAMatch {
+	if !donor.typed() || !patient.typed() {
+		return nil
+	}
+	m := &HLAMatch{}
+	complete8, complete10 := true, true
+	matched8 := 0
+	for i, name := range hlaLoci {
+		p := pair(*patient.locus(name))
+		d := pair(*donor.locus(name))
+		if len(p) == 0 || len(d) == 0 {
+			m.Untyped = append(m.Untyped, name)
+			complete10 = false
+			if i < 4 {
+				complete8 = false
+			}
+			continue
+		}
+
+		count := func(a, b int) int {
+			n := 0
+			if sameAllele(p[0], d[a]) {
+				n++
+			}
+			if sameAllele(p[1], d[b]) {
+				n++
+			}
+			return n
+		}
+		matched := count(0, 1)
+		if crossed := count(1, 0); crossed > matched {
+			matched = crossed
+		}
+
+		m.Loci = append(m.Loci, HLALocusMatch{Locus: name, Matched: matched, Patient: p, Donor: d})
+		m.Matched += matched
+		m.Of += 2
+		if i < 4 {
+			matched8 += matched
+		}
+		if matched < 2 {
+			m.Mismatches = append(m.Mismatches, fmt.Sprintf("%s: patient %s, donor %s", name, strings.Join(p, " "), strings.Join(d, " ")))
+		}
+	}
+	if complete8 {
+		m.Match8 = fmt.Sprintf("%d/8", matched8)
+	}
+	if complete10 {
+		m.Match10 = fmt.Sprintf("%d/10", m.Matched)
+	}
+	return m
+}
+
+//hlaMatters reports whether HLA is matched for any of the donation types
+func hlaMatters(types []string) bool {
+	for _, id := range types {
+		if t, ok := donationType(id); ok && t.Category != "blood_component" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,20 @@
+package main
+
+//allocateId hands out the next user id. ids come from a sequence kept in the
+//snapshot and are never reused, whatever happens to the Total counters
+func (hs *Hospital) allocateId() int {
+	if hs.NextId < 1 {
+		hs.NextId = 1
+	}
+	id := hs.NextId
+	hs.NextId += 1
+	return id
+}
+
+//seeId moves the sequence past id, so ids replayed from the journal are never
+//handed out again
+func (hs *Hospital) seeId(id int) {
+	if id >= hs.NextId {
+		hs.NextId = id + 1
+	}
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+type EventType string
+
+const (
+	EventSignup           EventType = "signup"
+	EventUpdateContact    EventType = "update_contact"
+	EventDeleteUser       EventType = "delete_user"
+	EventSendRequest      EventType = "send_request"
+	EventAcceptRequest    EventType = "accept_request"
+	EventCancelRequest    EventType = "cancel_request"
+	EventCancelConnection EventType = "cancel_connection"
+	EventRotateSecret     EventType = "rotate_secret"
+	EventRevokeSecret     EventType = "revoke_secret"
+	EventVerifySecret     EventType = "verify_secret"
+	EventCreateStaff      EventType = "create_staff"
+	EventDeactivateStaff  EventType = "deactivate_staff"
+	EventReactivateStaff  EventType = "reactivate_staff"
+	EventForceDisconnect  EventType = "force_disconnect"
+	EventDeactivateUser   EventType = "deactivate_user"
+	EventReactivateUser   EventType = "reactivate_user"
+	EventRepairUser       EventType = "repair_user"
+	EventSetUrgency       EventType = "set_urgency"
+	EventBroadcast        EventType = "broadcast"
+	EventCloseBroadcast   EventType = "close_broadcast"
+	EventExpireRequests   EventType = "expire_requests"
+	EventDeclineRequest   EventType = "decline_request"
+	EventUnblockUser      EventType = "unblock_user"
+	EventFsckRepair       EventType = "fsck_repair"
+)
+
+//Event is one entry of the journal. Users holds the state of every user the
+//action touched after it was applied, so replaying an event never has to
+//re-run handler logic
+type Event struct {
+	Seq           uint64        `json:"seq"`
+	Type          EventType     `json:"type"`
+	UserId        int           `json:"user_id"`
+	CounterpartId int           `json:"counterpart_id,omitempty"`
+	Time          time.Time     `json:"time"`
+	Users         []User        `json:"users,omitempty"`
+	Deleted       []int         `json:"deleted,omitempty"`
+	Staff         []StaffMember `json:"staff,omitempty"`
+	Broadcasts    []Broadcast   `json:"broadcasts,omitempty"`
+	//requests the action opened or closed. their requested edges follow them
+	Requests []Request `json:"requests,omitempty"`
+	//connected and blocked edges the action added and dropped
+	Linked   []Edge `json:"linked,omitempty"`
+	Unlinked []Edge `json:"unlinked,omitempty"`
+	//selectors of stale credentials dropped by a repair
+	RevokedSelectors []string          `json:"revoked_selectors,omitempty"`
+	Credential       *SecretCredential `json:"credential,omitempty"`
+	Recount          bool              `json:"recount,omitempty"` //set by a repair: the totals are recounted from the stored users
+	Audit            *AuditEntry       `json:"audit,omitempty"`   //the entry the action added to the audit trail
+}
+
+//apply folds ev into the store
+func (hs *Hospital) apply(ev Event) {
+	for _, user := range ev.Users {
+		hs.seeId(user.Id)
+		_, isPatient := hs.Patients[user.Id]
+		_, isDonor := hs.Donors[user.Id]
+		if !isPatient && !isDonor {
+			hs.Total += 1
+			if user.Type == Donor {
+				hs.TotalDonors += 1
+			} else {
+				hs.TotalPatients += 1
+			}
+		}
+
+		if user.Type == Donor {
+			hs.Donors[user.Id] = withoutRelations(user)
+		} else {
+			hs.Patients[user.Id] = withoutRelations(user)
+		}
+	}
+
+	for _, member := range ev.Staff {
+		hs.seeId(member.Id)
+		hs.Staff[member.Id] = member
+	}
+
+	for _, b := range ev.Broadcasts {
+		hs.Broadcasts[b.Id] = b
+	}
+
+	for _, selector := range ev.RevokedSelectors {
+		delete(hs.Credentials, selector)
+	}
+
+	if ev.Credential != nil {
+		userType := Patient
+		if _, ok := hs.Donors[ev.UserId]; ok {
+			userType = Donor
+		}
+		if member, ok := hs.Staff[ev.UserId]; ok {
+			userType = member.Role
+		}
+		hs.putCredential(ev.UserId, userType, *ev.Credential)
+	}
+
+	if len(ev.Deleted) > 0 {
+		hs.notifyDeleted(ev)
+	}
+	for _, id := range ev.Deleted {
+		if _, ok := hs.Patients[id]; ok {
+			delete(hs.Patients, id)
+			hs.Total -= 1
+			hs.TotalPatients -= 1
+		}
+		if _, ok := hs.Donors[id]; ok {
+			delete(hs.Donors, id)
+			hs.Total -= 1
+			hs.TotalDonors -= 1
+		}
+		if selector, ok := hs.IdsToSelectors[id]; ok {
+			delete(hs.Credentials, selector)
+			delete(hs.IdsToSelectors, id)
+		}
+		hs.unlinkUser(id)
+	}
+
+	touched := append([]int(nil), ev.Deleted...)
+	for _, user := range ev.Users {
+		touched = append(touched, user.Id)
+	}
+	for _, r := range ev.Requests {
+		hs.seeRequestId(r.Id)
+		hs.Requests[r.Id] = r
+		touched = append(touched, r.SenderId, r.RecipientId)
+	}
+	hs.linkRequests(ev.Requests)
+	for _, e := range ev.Unlinked {
+		hs.unlink(e.State, e.From, e.To)
+		touched = append(touched, e.From, e.To)
+	}
+	for _, e := range ev.Linked {
+		if old, ok := hs.Graph.edge(e.State, e.From, e.To); ok {
+			e.Since = old.Since
+		} else if e.Since.IsZero() {
+			e.Since = ev.Time
+		}
+		hs.link(e)
+		touched = append(touched, e.From, e.To)
+	}
+	hs.notifyRequests(ev.Requests, ev.Time)
+	if len(ev.Deleted) > 0 {
+		hs.dropBroadcastResponses(ev.Deleted)
+	}
+
+	hs.syncBroadcasts(touched, ev.Time)
+	if ev.Recount {
+		hs.recount()
+	}
+
+	if ev.Audit != nil {
+		hs.AuditSeq = ev.Audit.Seq
+		hs.AuditHead = ev.Audit.Hash
+	}
+
+	hs.Seq = ev.Seq
+}
+
+//journal is the append-only event log kept next to the snapshot
+type journal struct {
+	path         string
+	file         *os.File
+	pending      int //events appended since the last compaction
+	compactEvery int
+}
+
+func journalPath(dataFile string) string {
+	return dataFile + ".journal"
+}
+
+func openJournal(path string, compactEvery int) (*journal, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &journal{
+		path:         path,
+		file:         file,
+		compactEvery: compactEvery,
+	}, nil
+}
+
+//append writes ev as one json line and syncs it to disk
+func (j *journal) append(ev Event) error {
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if _, err := j.file.Write(data); err != nil {
+		return err
+	}
+	if err := j.file.Sync(); err != nil {
+		return err
+	}
+	j.pending += 1
+	return nil
+}
+
+func (j *journal) needsCompaction() bool {
+	return j.compactEvery > 0 && j.pending >= j.compactEvery
+}
+
+//compact snapshots hospital and empties the journal, whose events are all in
+//the snapshot now. the journal file stays open throughout, so a compaction
+//that fails leaves appends working and is retried on the next event. a crash
+//between the two steps only leaves events replay skips as already applied
+func (j *journal) compact(dataFile string, hospital Hospital) error {
+	if err := saveHospital(dataFile, hospital); err != nil {
+		return err
+	}
+	if err := j.file.Truncate(0); err != nil {
+		return err
+	}
+	if err := j.file.Sync(); err != nil {
+		return err
+	}
+	j.pending = 0
+	return nil
+}
+
+//replayJournal applies every event of the journal at path newer than the
+//snapshot already loaded into hospital. a torn last line left by a crash
+//mid-append is skipped, and with truncate cut off so later appends start on
+//a clean line. the audit entries of every event in the journal, applied or
+//not, are returned so a trail that missed them can catch up
+func replayJournal(path string, hospital *Hospital, truncate bool) (int, []AuditEntry, error) {
+	audited := []AuditEntry{}
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return 0, audited, nil
+	}
+	if err != nil {
+		return 0, audited, err
+	}
+	defer file.Close()
+
+	replayed := 0
+	var offset int64
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 && truncate {
+				return replayed, audited, os.Truncate(path, offset)
+			}
+			return replayed, audited, nil
+		}
+		if err != nil {
+			return replayed, audited, err
+		}
+		offset += int64(len(line))
+
+		var ev Event
+		if e := json.Unmarshal(line, &ev); e != nil {
+			return replayed, audited, fmt.Errorf("journal %s: bad event after seq %d: %v", path, hospital.Seq, e)
+		}
+		if ev.Audit != nil {
+			audited = append(audited, *ev.Audit)
+		}
+		if ev.Seq <= hospital.Seq {
+			continue
+		}
+		hospital.apply(ev)
+		replayed += 1
+	}
+}
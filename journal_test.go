@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+//fillStore commits n signups and a request between the first two users to fs
+func fillStore(t *testing.T, fs *fileStore, n int) {
+	t.Helper()
+	ids := []int{}
+	for i := 0; i < n; i++ {
+		typ, group := Patient, BloodGroup("A+")
+		if i%2 == 1 {
+			typ, group = Donor, "O-"
+		}
+		ids = append(ids, addTestUser(t, fs.memStore, typ, group).Id)
+	}
+	if n < 2 {
+		return
+	}
+	err := fs.UpdatePair(nil, EventSendRequest, ids[0], ids[1], func(tx *pairTx) error {
+		tx.requests.open(ids[0], ids[1], "", time.Hour)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+//reopen closes fs and opens the store at its data file again
+func reopen(t *testing.T, fs *fileStore, compactEvery int) *fileStore {
+	t.Helper()
+	if err := fs.Close(); err != nil {
+		t.Fatal(err)
+	}
+	fs, err := openFileStore(fs.dataFile, compactEvery, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fs
+}
+
+func hospitalJSON(t *testing.T, fs *fileStore) string {
+	t.Helper()
+	data, err := json.Marshal(fs.hospital)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestJournalReplay(t *testing.T) {
+	tests := []struct {
+		name         string
+		compactEvery int
+		users        int
+	}{
+		{"empty", 0, 0},
+		{"never compacted", 0, 10},
+		{"compacted every event", 1, 10},
+		{"compacted midway", 4, 10},
+		{"compaction due", 11, 10},
+	}
+	for _, tt := range tests {
+		dataFile := filepath.Join(t.TempDir(), "store.json")
+		fs, err := openFileStore(dataFile, tt.compactEvery, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fillStore(t, fs, tt.users)
+		want := hospitalJSON(t, fs)
+
+		fs = reopen(t, fs, tt.compactEvery)
+		if got := hospitalJSON(t, fs); got != want {
+			t.Errorf("%s: replayed store differs\n got %s\nwant %s", tt.name, got, want)
+		}
+		if tt.compactEvery > 0 && fs.journal.pending > tt.compactEvery {
+			t.Errorf("%s: %d events in the journal, compacting every %d", tt.name, fs.journal.pending, tt.compactEvery)
+		}
+
+		//the reopened store goes on from where it was
+		fillStore(t, fs, 2)
+		want = hospitalJSON(t, fs)
+		fs = reopen(t, fs, tt.compactEvery)
+		if got := hospitalJSON(t, fs); got != want {
+			t.Errorf("%s: store differs after a second run\n got %s\nwant %s", tt.name, got, want)
+		}
+		fs.Close()
+	}
+}
+
+func TestJournalTornLine(t *testing.T) {
+	dataFile := filepath.Join(t.TempDir(), "store.json")
+	fs, err := openFileStore(dataFile, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fillStore(t, fs, 3)
+	want := hospitalJSON(t, fs)
+	fs.Close()
+
+	//a crash mid-append leaves half an event without its newline
+	journal, err := os.OpenFile(journalPath(dataFile), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	journal.Write([]byte(`{"seq":99,"type":"sig`))
+	journal.Close()
+
+	//a read-only open skips it and leaves it be
+	ro, err := openFileStore(dataFile, 0, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := hospitalJSON(t, ro); got != want {
+		t.Errorf("read-only store differs\n got %s\nwant %s", got, want)
+	}
+	ro.Close()
+	before, _ := os.Stat(journalPath(dataFile))
+
+	fs, err = openFileStore(dataFile, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := hospitalJSON(t, fs); got != want {
+		t.Errorf("store differs\n got %s\nwant %s", got, want)
+	}
+	if after, _ := os.Stat(journalPath(dataFile)); after.Size() >= before.Size() {
+		t.Errorf("torn line left in the journal, %d bytes before, %d after", before.Size(), after.Size())
+	}
+
+	//events appended after the cut replay on a clean line
+	fillStore(t, fs, 1)
+	want = hospitalJSON(t, fs)
+	fs = reopen(t, fs, 0)
+	if got := hospitalJSON(t, fs); got != want {
+		t.Errorf("store differs after appending past the cut\n got %s\nwant %s", got, want)
+	}
+	fs.Close()
+}
+
+func TestJournalCompactionCrash(t *testing.T) {
+	dataFile := filepath.Join(t.TempDir(), "store.json")
+	fs, err := openFileStore(dataFile, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fillStore(t, fs, 4)
+	want := hospitalJSON(t, fs)
+
+	//a crash after the snapshot is saved but before the journal is emptied
+	//leaves events in the journal the snapshot already has
+	if err := saveHospital(dataFile, fs.hospital); err != nil {
+		t.Fatal(err)
+	}
+	fs = reopen(t, fs, 0)
+	if got := hospitalJSON(t, fs); got != want {
+		t.Errorf("events applied twice\n got %s\nwant %s", got, want)
+	}
+	fs.Close()
+}
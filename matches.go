@@ -0,0 +1,225 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//dateLayout is how calendar dates, like a donor's last donation, are written
+const dateLayout = "2006-01-02"
+
+//factorWeights is how much each factor counts towards a match score
+var factorWeights = []struct {
+	Factor string
+	Weight float64
+}{
+	{"blood", 0.35},
+	{"distance", 0.2},
+	{"availability", 0.15},
+	{"last_donation", 0.15},
+	{"response_rate", 0.15},
+	{"hla", 0.35}, //only counted for donation types matched on HLA
+}
+
+//MatchFactor is the score, from 0 to 1, of a donor for one factor and why
+type MatchFactor struct {
+	Factor string  `json:"factor"`
+	Score  float64 `json:"score"`
+	Weight float64 `json:"weight"`
+	Detail string  `json:"detail"`
+}
+
+//Match is a donor ranked for a patient. Score is the weighted mean of Factors
+type Match struct {
+	Donor   publicUser    `json:"donor"`
+	HLA     *HLAMatch     `json:"hla,omitempty"`
+	Score   float64       `json:"score"`
+	Factors []MatchFactor `json:"factors"`
+}
+
+//scoreFactor scores donor for patient on one factor
+func scoreFactor(factor string, donor User, patient User, rules eligibilityRules, e Eligibility, now time.Time) (float64, string) {
+	switch factor {
+	case "blood":
+		best, t := bestCompatibility(sharedTypes(donor, patient), donor, patient)
+		switch best {
+		case Compatible:
+			if donor.BloodGroup == patient.BloodGroup {
+				return 1, fmt.Sprintf("%s %s, identical group", donor.BloodGroup, t)
+			}
+			return 0.9, fmt.Sprintf("%s %s is compatible with %s", donor.BloodGroup, t, patient.BloodGroup)
+		case Caution:
+			return 0.5, fmt.Sprintf("%s %s is acceptable for %s when nothing better is available", donor.BloodGroup, t, patient.BloodGroup)
+		case Unknown:
+			return 0.5, "blood group not on record"
+		default:
+			return 0, fmt.Sprintf("%s %s is incompatible with %s", donor.BloodGroup, t, patient.BloodGroup)
+		}
+
+	case "distance":
+		//from where the donor is published, the score would give the exact distance away
+		km, ok := distanceKm(User{Location: publicLocation(donor.Location)}, patient)
+		if !ok {
+			return 0.5, "location not on record"
+		}
+		//full score next door, half at 25km
+		return 1 / (1 + km/25), fmt.Sprintf("%.1f km away", km)
+
+	case "availability":
+		if donor.Unavailable {
+			return 0, "marked unavailable"
+		}
+		if !e.Eligible {
+			if e.NextEligible == "" {
+				return 0, "not eligible to donate"
+			}
+			return 0, "not eligible to donate until " + e.NextEligible
+		}
+		return 1, "available"
+
+	case "last_donation":
+		if donor.LastDonation == "" {
+			return 1, "no donation on record"
+		}
+		last, err := time.Parse(dateLayout, donor.LastDonation)
+		if err != nil {
+			return 0.5, "last donation date unreadable"
+		}
+		kind := donor.LastDonationKind
+		if kind == "" {
+			kind = WholeBlood
+		}
+		//full score once the deferral interval of the last donation is over
+		days := now.Sub(last).Hours() / 24
+		score := 1.0
+		if interval := rules.IntervalDays[kind]; interval > 0 {
+			score = math.Max(0, math.Min(1, days/float64(interval)))
+		}
+		return score, fmt.Sprintf("last donated %s %d days ago", kind, int(days))
+
+	case "response_rate":
+		if donor.RequestsReceived == 0 {
+			return 0.5, "no requests received yet"
+		}
+		rate := float64(donor.RequestsAnswered) / float64(donor.RequestsReceived)
+		return math.Min(1, rate), fmt.Sprintf("accepts %.0f%% of requests", math.Min(1, rate)*100)
+
+	case "hla":
+		m := matchHLA(donor.HLA, patient.HLA)
+		if m == nil {
+			return 0.5, "hla not typed"
+		}
+		detail := fmt.Sprintf("%d/%d alleles", m.Matched, m.Of)
+		if m.Match10 != "" {
+			detail = m.Match10
+		} else if m.Match8 != "" {
+			detail = m.Match8
+		}
+		return float64(m.Matched) / float64(m.Of), detail
+	}
+	return 0, ""
+}
+
+//matchDonor scores donor for patient on every factor. the score is divided
+//by the total weight, so leaving out hla for blood components keeps scores
+//between 0 and 1
+func matchDonor(donor User, patient User, rules eligibilityRules, now time.Time) Match {
+	shared := sharedTypes(donor, patient)
+	e := rules.check(donor, shared, now)
+	match := Match{Donor: publicView(donor, &e)}
+	if hlaMatters(shared) {
+		match.HLA = matchHLA(donor.HLA, patient.HLA)
+	}
+
+	total := 0.0
+	for _, f := range factorWeights {
+		score, detail := scoreFactor(f.Factor, donor, patient, rules, e, now)
+		weight := f.Weight
+		if f.Factor == "hla" && !hlaMatters(shared) {
+			weight = 0
+			detail = "not matched on hla for " + strings.Join(shared, ", ")
+		}
+		score = math.Round(score*1000) / 1000
+		match.Factors = append(match.Factors, MatchFactor{
+			Factor: f.Factor,
+			Score:  score,
+			Weight: weight,
+			Detail: detail,
+		})
+		match.Score += score * weight
+		total += weight
+	}
+	match.Score = math.Round(match.Score/total*1000) / 1000
+	return match
+}
+
+//rankMatches sorts matches best first, donors with equal scores by id
+func rankMatches(matches []Match) {
+	sort.SliceStable(matches, func(i, j int) bool {
+		if matches[i].Score != matches[j].Score {
+			return matches[i].Score > matches[j].Score
+		}
+		return matches[i].Donor.Id < matches[j].Donor.Id
+	})
+}
+
+// GET /user/{id}/matches
+//getMatches ranks the donors a patient could request, best first. donors the
+//patient already requested or is connected to are left out, and so are donors
+//offering none of the types the patient needs or whose blood the -blood-check
+//would reject. donors not eligible to donate yet stay listed, with no score
+//for availability, so patients can plan ahead
+func (h *usersHandler) getMatches(w http.ResponseWriter, r *http.Request, t string) {
+	userId, err := strconv.Atoi(t)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("err: invalid User id. Check Input UserId")))
+		return
+	}
+
+	patient, err := h.store.GetUser(userId)
+	if err != nil {
+		writeStoreError(w, err, "UserId")
+		return
+	}
+	if patient.Type != Patient {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("err: matches are only listed for patients")))
+		return
+	}
+
+	//donors the patient already asked or is connected with
+	dealt := map[int]bool{}
+	for _, ids := range [][]int{patient.RequestedUserIds, patient.ConnectedUsersIds} {
+		for _, id := range ids {
+			dealt[id] = true
+		}
+	}
+
+	now := time.Now()
+	matches := []Match{}
+	for _, donor := range activeUsers(h.store.ListUsers(Donor)) {
+		if dealt[donor.Id] {
+			continue
+		}
+		if _, err := checkTypes(donor, patient); err != nil {
+			continue
+		}
+		if _, err := h.checkBlood(donor, patient); err != nil {
+			continue
+		}
+		matches = append(matches, matchDonor(donor, patient, h.rules, now))
+	}
+
+	rankMatches(matches)
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"patient_id": patient.Id,
+		"matches":    matches,
+	})
+}
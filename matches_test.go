@@ -0,0 +1,97 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRankDonors(t *testing.T) {
+	now := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	here := &Location{Lat: 10, Lng: 10}
+	//on the grid locations are published to, 22.2km north of here
+	away := &Location{Lat: 10.2, Lng: 10}
+	patient := User{Id: 1, Type: Patient, BloodGroup: "A+", Location: here}
+	donor := func(id int, group BloodGroup, at *Location) User {
+		return User{Id: id, Type: Donor, BloodGroup: group, Location: at, DateOfBirth: "1990-01-01", WeightKg: 70}
+	}
+
+	tests := []struct {
+		name    string
+		donor   User
+		factors map[string]float64
+		score   float64
+	}{
+		{
+			name: "ideal",
+			donor: func() User {
+				d := donor(2, "A+", here)
+				d.RequestsReceived, d.RequestsAnswered = 10, 10
+				return d
+			}(),
+			factors: map[string]float64{"blood": 1, "distance": 1, "availability": 1, "last_donation": 1, "response_rate": 1},
+			score:   1,
+		},
+		{
+			//0.35*0.9 + 0.2*0.529 + 0.15 + 0.15 + 0.15*0.25
+			name: "compatible, far and mostly ignoring requests",
+			donor: func() User {
+				d := donor(3, "O-", away)
+				d.RequestsReceived, d.RequestsAnswered = 4, 1
+				return d
+			}(),
+			factors: map[string]float64{"blood": 0.9, "distance": 0.529, "availability": 1, "last_donation": 1, "response_rate": 0.25},
+			score:   0.758,
+		},
+		{
+			//0.35 + 0.2 + 0 + 0.15*0.5 + 0.15*0.5
+			name: "donated four weeks ago",
+			donor: func() User {
+				d := donor(4, "A+", here)
+				d.LastDonation = now.AddDate(0, 0, -28).Format(dateLayout)
+				return d
+			}(),
+			factors: map[string]float64{"blood": 1, "distance": 1, "availability": 0, "last_donation": 0.5, "response_rate": 0.5},
+			score:   0.7,
+		},
+		{
+			//0.35 + 0.2 + 0 + 0.15 + 0.15*0.5
+			name: "unavailable",
+			donor: func() User {
+				d := donor(5, "A+", here)
+				d.Unavailable = true
+				return d
+			}(),
+			factors: map[string]float64{"blood": 1, "distance": 1, "availability": 0, "last_donation": 1, "response_rate": 0.5},
+			score:   0.775,
+		},
+	}
+
+	matches := []Match{}
+	for _, tt := range tests {
+		m := matchDonor(tt.donor, patient, defaultEligibilityRules(), now)
+		for _, f := range m.Factors {
+			want, ok := tt.factors[f.Factor]
+			if !ok {
+				if f.Weight != 0 {
+					t.Errorf("%s: %s counted with weight %v", tt.name, f.Factor, f.Weight)
+				}
+				continue
+			}
+			if f.Score != want {
+				t.Errorf("%s: %s scored %v (%s), want %v", tt.name, f.Factor, f.Score, f.Detail, want)
+			}
+		}
+		if m.Score != tt.score {
+			t.Errorf("%s: score %v, want %v", tt.name, m.Score, tt.score)
+		}
+		matches = append(matches, m)
+	}
+
+	rankMatches(matches)
+	want := []int{2, 5, 3, 4}
+	for i, m := range matches {
+		if m.Donor.Id != want[i] {
+			t.Errorf("rank %d: donor %d, want %d", i+1, m.Donor.Id, want[i])
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+//notification kinds
+const (
+	NotifyRequestDeclined = "request_declined"
+	NotifyUserDeleted     = "user_deleted"
+)
+
+//Notification tells a user about something another user did. notifications
+//are derived from events by apply, never written by handlers directly
+type Notification struct {
+	Id            int       `json:"id"`
+	UserId        int       `json:"user_id"`
+	Time          time.Time `json:"time"`
+	Kind          string    `json:"kind"`
+	CounterpartId int       `json:"counterpart_id,omitempty"`
+	RequestId     int       `json:"request_id,omitempty"`
+	Text          string    `json:"text"`
+}
+
+func (hs *Hospital) notify(n Notification) {
+	n.Id = len(hs.Notifications) + 1
+	hs.Notifications[n.Id] = n
+}
+
+//notifyRequests notifies the users on the other side of requests that just
+//left pending, where they need to know
+func (hs *Hospital) notifyRequests(requests []Request, at time.Time) {
+	for _, r := range requests {
+		if r.State != RequestDeclined {
+			continue
+		}
+		name := "user"
+		if _, ok := hs.Donors[r.RecipientId]; ok {
+			name = "donor"
+		} else if _, ok := hs.Patients[r.RecipientId]; ok {
+			name = "patient"
+		}
+		text := fmt.Sprintf("%sId: %d declined your request", name, r.RecipientId)
+		if r.Reason != "" {
+			text += ": " + r.Reason
+		}
+		hs.notify(Notification{UserId: r.SenderId, Time: at, Kind: NotifyRequestDeclined, CounterpartId: r.RecipientId, RequestId: r.Id, Text: text})
+	}
+}
+
+//notificationsOf returns the notifications of the user with id after sinceId, newest first
+func (hs *Hospital) notificationsOf(id int, sinceId int) []Notification {
+	list := []Notification{}
+	for _, n := range hs.Notifications {
+		if n.UserId == id && n.Id > sinceId {
+			list = append(list, n)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Id > list[j].Id
+	})
+	return list
+}
+
+// GET /user/{id}/notifications?since_id=
+func (h *usersHandler) getNotifications(w http.ResponseWriter, r *http.Request, t string) {
+	userId, err := strconv.Atoi(t)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("err: invalid User id. Check Input UserId")))
+		return
+	}
+
+	sinceId := 0
+	if s := r.URL.Query().Get("since_id"); s != "" {
+		if sinceId, err = strconv.Atoi(s); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(fmt.Sprintf("err: since_id must be a notification id")))
+			return
+		}
+	}
+
+	if _, err := h.store.GetUser(userId); err != nil {
+		writeStoreError(w, err, "UserId")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, h.store.Notifications(userId, sinceId))
+}
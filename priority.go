@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+//urgency levels of a patient, set by staff
+const (
+	Routine  = "routine"
+	Urgent   = "urgent"
+	Critical = "critical"
+)
+
+var urgencyRank = map[string]int{Routine: 0, Urgent: 1, Critical: 2}
+
+//urgencyOf is the urgency of patient, routine unless staff raised it
+func urgencyOf(patient User) string {
+	if patient.Urgency == "" {
+		return Routine
+	}
+	return patient.Urgency
+}
+
+//sortByPriority orders patients most urgent first, then earliest required-by
+//date, so overdue patients lead, then longest waiting. a patient registered
+//before registration was recorded has waited for an unknown time and comes
+//after those known to wait
+func sortByPriority(patients []User) {
+	sort.SliceStable(patients, func(i, j int) bool {
+		a, b := patients[i], patients[j]
+		if ra, rb := urgencyRank[urgencyOf(a)], urgencyRank[urgencyOf(b)]; ra != rb {
+			return ra > rb
+		}
+		if a.RequiredBy != b.RequiredBy {
+			//any date comes before none
+			return b.RequiredBy == "" || a.RequiredBy != "" && a.RequiredBy < b.RequiredBy
+		}
+		if !a.RegisteredAt.Equal(b.RegisteredAt) {
+			//any registration time comes before none
+			return b.RegisteredAt.IsZero() || !a.RegisteredAt.IsZero() && a.RegisteredAt.Before(b.RegisteredAt)
+		}
+		return a.Id < b.Id
+	})
+}
+
+//waitlistEntry is a patient on the waitlist
+type waitlistEntry struct {
+	User
+	Position    int  `json:"position"`
+	WaitingDays int  `json:"waiting_days"`      //0 for patients registered before registration was recorded
+	Overdue     bool `json:"overdue,omitempty"` //the required-by date has passed
+}
+
+// GET /admin/waitlist
+//getWaitlist lists active patients without a connection yet, in priority order
+func (h *usersHandler) getWaitlist(w http.ResponseWriter, r *http.Request) {
+	patients := []User{}
+	for _, patient := range activeUsers(h.store.ListUsers(Patient)) {
+		if len(patient.ConnectedUsersIds) == 0 {
+			patients = append(patients, patient)
+		}
+	}
+	sortByPriority(patients)
+
+	now := time.Now().UTC()
+	today := now.Format(dateLayout)
+	list := make([]waitlistEntry, 0, len(patients))
+	for i, patient := range patients {
+		entry := waitlistEntry{User: patient, Position: i + 1}
+		if !patient.RegisteredAt.IsZero() {
+			entry.WaitingDays = int(now.Sub(patient.RegisteredAt).Hours() / 24)
+		}
+		entry.Overdue = patient.RequiredBy != "" && patient.RequiredBy < today
+		list = append(list, entry)
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+// POST /admin/users/{id}/urgency
+//setUrgency sets the urgency and required-by date of a patient. an empty
+//required_by clears the date
+func (h *usersHandler) setUrgency(w http.ResponseWriter, r *http.Request, t string) {
+	userId, err := strconv.Atoi(t)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("err: invalid User id. Check Input UserId")))
+		return
+	}
+
+	bodyBytes, err := ioutil.ReadAll(r.Body)
+	defer r.Body.Close()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	var body struct {
+		Urgency    string `json:"urgency"`
+		RequiredBy string `json:"required_by"`
+	}
+	if err := json.Unmarshal(bodyBytes, &body); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if _, ok := urgencyRank[body.Urgency]; !ok {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		w.Write([]byte(fmt.Sprintf("err: enter valid urgency. \n routine \n urgent \n critical")))
+		return
+	}
+	if body.RequiredBy != "" {
+		if _, err := time.Parse(dateLayout, body.RequiredBy); err != nil {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			w.Write([]byte(fmt.Sprintf("err: required_by must be a date like 2006-01-02")))
+			return
+		}
+	}
+
+	user, err := h.store.UpdateUser(audited(r), EventSetUrgency, userId, func(user *User) error {
+		if user.Type != Patient {
+			return &httpError{http.StatusUnprocessableEntity, fmt.Sprintf("err: urgency is only kept for patients")}
+		}
+		if urgencyOf(*user) == body.Urgency && user.RequiredBy == body.RequiredBy {
+			return errNoChange
+		}
+		user.Urgency = body.Urgency
+		user.RequiredBy = body.RequiredBy
+		return nil
+	})
+	if err != nil {
+		writeStoreError(w, err, "UserId")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, user)
+}
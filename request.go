@@ -0,0 +1,264 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+//request states. a request only ever leaves pending
+const (
+	RequestPending   = "pending"
+	RequestAccepted  = "accepted"
+	RequestDeclined  = "declined"
+	RequestCancelled = "cancelled"
+	RequestExpired   = "expired"
+)
+
+//Request is a request sent from one user to another. a pending request has a
+//requested edge in the graph, which is what RequestedUserIds and
+//PendingUserIds are produced from
+type Request struct {
+	Id          int        `json:"id"`
+	SenderId    int        `json:"sender_id"`
+	RecipientId int        `json:"recipient_id"`
+	CreatedAt   time.Time  `json:"created_at"` //zero for requests sent before they were recorded
+	UpdatedAt   time.Time  `json:"updated_at"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"` //nil when requests do not expire
+	Message     string     `json:"message,omitempty"`
+	Reason      string     `json:"reason,omitempty"` //given by the recipient when declining
+	State       string     `json:"state"`
+	BroadcastId int        `json:"broadcast_id,omitempty"` //set when the request went out with a broadcast
+}
+
+//requestBook holds copies of the pending requests among the users of a store
+//update. changes made through it are committed with the users
+type requestBook struct {
+	requests map[int]Request
+	nextId   int
+	now      time.Time
+	changed  []int
+}
+
+//pending returns the pending request from senderId to recipientId. one past
+//its expiry the sweep has not got to yet is staged as expired instead, so it
+//can not be answered however late the sweep runs
+func (b *requestBook) pending(senderId int, recipientId int) (Request, bool) {
+	r, ok := b.get(senderId, recipientId, RequestPending)
+	if ok && r.ExpiresAt != nil && !r.ExpiresAt.After(b.now) {
+		r.State = RequestExpired
+		r.UpdatedAt = b.now
+		b.put(r)
+		return Request{}, false
+	}
+	return r, ok
+}
+
+//get returns the request from senderId to recipientId in state, staged or not
+func (b *requestBook) get(senderId int, recipientId int, state string) (Request, bool) {
+	for _, r := range b.requests {
+		if r.SenderId == senderId && r.RecipientId == recipientId && r.State == state {
+			return r, true
+		}
+	}
+	return Request{}, false
+}
+
+//open stages a new pending request, expiring after ttl unless ttl is 0
+func (b *requestBook) open(senderId int, recipientId int, message string, ttl time.Duration) Request {
+	r := Request{
+		Id:          b.nextId,
+		SenderId:    senderId,
+		RecipientId: recipientId,
+		CreatedAt:   b.now,
+		UpdatedAt:   b.now,
+		Message:     message,
+		State:       RequestPending,
+	}
+	if ttl > 0 {
+		expires := b.now.Add(ttl)
+		r.ExpiresAt = &expires
+	}
+	b.nextId++
+	b.put(r)
+	return r
+}
+
+//settle moves the pending request from senderId to recipientId to state,
+//reporting whether there was one
+func (b *requestBook) settle(senderId int, recipientId int, state string) bool {
+	r, ok := b.pending(senderId, recipientId)
+	if !ok {
+		return false
+	}
+	r.State = state
+	r.UpdatedAt = b.now
+	b.put(r)
+	return true
+}
+
+//decline moves the pending request from senderId to recipientId to declined
+//for reason
+func (b *requestBook) decline(senderId int, recipientId int, reason string) (Request, bool) {
+	r, ok := b.pending(senderId, recipientId)
+	if !ok {
+		return Request{}, false
+	}
+	r.State = RequestDeclined
+	r.Reason = reason
+	r.UpdatedAt = b.now
+	b.put(r)
+	return r, true
+}
+
+func (b *requestBook) put(r Request) {
+	b.requests[r.Id] = r
+	if !containsId(b.changed, r.Id) {
+		b.changed = append(b.changed, r.Id)
+	}
+}
+
+//changes returns the requests staged in b, in id order
+func (b *requestBook) changes() []Request {
+	list := make([]Request, 0, len(b.changed))
+	for _, id := range b.changed {
+		list = append(list, b.requests[id])
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Id < list[j].Id
+	})
+	return list
+}
+
+func containsId(ids []int, id int) bool {
+	return find(ids, id) != -1
+}
+
+//requestBook opens a book on the pending requests among the users with ids.
+//they are found through the requested edges of the users, not by scanning
+//every request
+func (hs *Hospital) requestBook(ids ...int) *requestBook {
+	b := &requestBook{
+		requests: map[int]Request{},
+		nextId:   hs.NextRequestId,
+		now:      time.Now().UTC(),
+	}
+	among := make(map[int]bool, len(ids))
+	for _, id := range ids {
+		among[id] = true
+	}
+	for _, id := range ids {
+		for to, e := range hs.Graph.edgesFrom(EdgeRequested, id) {
+			if r, ok := hs.Requests[e.RequestId]; ok && among[to] && r.State == RequestPending {
+				b.requests[r.Id] = r
+			}
+		}
+	}
+	return b
+}
+
+//seeRequestId moves the request sequence past id, like seeId does for users
+func (hs *Hospital) seeRequestId(id int) {
+	if id >= hs.NextRequestId {
+		hs.NextRequestId = id + 1
+	}
+}
+
+//requestsOf returns the requests sent or received by the user with id, newest first
+func (hs *Hospital) requestsOf(id int) []Request {
+	list := []Request{}
+	for _, r := range hs.Requests {
+		if r.SenderId == id || r.RecipientId == id {
+			list = append(list, r)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Id > list[j].Id
+	})
+	return list
+}
+
+//expiredRequests returns the pending requests whose expiry is not after now
+func (hs *Hospital) expiredRequests(now time.Time) []Request {
+	list := []Request{}
+	for _, r := range hs.Requests {
+		if r.State == RequestPending && r.ExpiresAt != nil && !r.ExpiresAt.After(now) {
+			r.State = RequestExpired
+			r.UpdatedAt = now
+			list = append(list, r)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Id < list[j].Id
+	})
+	return list
+}
+
+// GET /user/{id}/requests?state=&direction=sent|received
+func (h *usersHandler) getRequests(w http.ResponseWriter, r *http.Request, t string) {
+	userId, err := strconv.Atoi(t)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("err: invalid User id. Check Input UserId")))
+		return
+	}
+
+	if _, err := h.store.GetUser(userId); err != nil {
+		writeStoreError(w, err, "UserId")
+		return
+	}
+
+	query := r.URL.Query()
+	state := query.Get("state")
+	direction := query.Get("direction")
+	if direction != "" && direction != "sent" && direction != "received" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("err: direction must be sent or received")))
+		return
+	}
+
+	list := []Request{}
+	for _, req := range h.store.Requests(userId) {
+		if state != "" && req.State != state {
+			continue
+		}
+		if direction == "sent" && req.SenderId != userId || direction == "received" && req.RecipientId != userId {
+			continue
+		}
+		list = append(list, req)
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+//maxRequestMessage is the longest message a request can carry, in bytes
+const maxRequestMessage = 1000
+
+//sweepInterval is how often requests that expire after ttl are looked for
+func sweepInterval(ttl time.Duration) time.Duration {
+	interval := ttl / 10
+	if interval < time.Second {
+		return time.Second
+	}
+	if interval > time.Minute {
+		return time.Minute
+	}
+	return interval
+}
+
+//expireRequests expires the pending requests past their expiry every interval
+func (h *usersHandler) expireRequests(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		expired, err := h.store.ExpireRequests(now.UTC())
+		if err != nil {
+			fmt.Println("request expiry error:", err)
+			continue
+		}
+		if len(expired) > 0 {
+			fmt.Printf("expired requests: %d\n", len(expired))
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+//addTestUser signs up a user of type typ with blood group group to store
+func addTestUser(t *testing.T, store *memStore, typ UserType, group BloodGroup) User {
+	t.Helper()
+	n := store.hospital.NextId
+	cred, err := hashSecretCode(fmt.Sprintf("TEST%04d", n), fmt.Sprintf("code-%d", n))
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err := store.CreateUser(nil, User{Name: "test", Address: "test", PhoneNo: "1", Type: typ, BloodGroup: group}, cred)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+func TestPendingRequestExpires(t *testing.T) {
+	tests := []struct {
+		ttl         time.Duration
+		wantPending bool
+	}{
+		{0, true},
+		{time.Hour, true},
+		{time.Nanosecond, false},
+	}
+	for _, tt := range tests {
+		store := newMemStore(emptyHospital())
+		patient := addTestUser(t, store, Patient, "A+")
+		donor := addTestUser(t, store, Donor, "O-")
+
+		var sent Request
+		err := store.UpdatePair(nil, EventSendRequest, patient.Id, donor.Id, func(tx *pairTx) error {
+			sent = tx.requests.open(patient.Id, donor.Id, "", tt.ttl)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond)
+
+		//the sweep has not run, the transaction alone has to notice
+		err = store.UpdatePair(nil, EventAcceptRequest, donor.Id, patient.Id, func(tx *pairTx) error {
+			if _, ok := tx.requests.pending(patient.Id, donor.Id); ok != tt.wantPending {
+				t.Errorf("ttl %v: pending %v, want %v", tt.ttl, ok, tt.wantPending)
+			}
+			if tx.requests.settle(patient.Id, donor.Id, RequestAccepted) != tt.wantPending {
+				t.Errorf("ttl %v: settled an expired request", tt.ttl)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := RequestAccepted
+		if !tt.wantPending {
+			want = RequestExpired
+		}
+		if got := store.hospital.Requests[sent.Id].State; got != want {
+			t.Errorf("ttl %v: request is %s, want %s", tt.ttl, got, want)
+		}
+		if store.hospital.Graph.has(EdgeRequested, patient.Id, donor.Id) {
+			t.Errorf("ttl %v: requested edge left behind", tt.ttl)
+		}
+	}
+}
+
+func TestRequestIdsAreNotReused(t *testing.T) {
+	hospital := emptyHospital()
+	hospital.NextRequestId = 7 //requests up to 6 were issued, not all of them are kept
+	store := newMemStore(hospital)
+	patient := addTestUser(t, store, Patient, "A+")
+	donor := addTestUser(t, store, Donor, "O-")
+
+	for want := 7; want < 10; want++ {
+		var r Request
+		err := store.UpdatePair(nil, EventSendRequest, patient.Id, donor.Id, func(tx *pairTx) error {
+			tx.requests.settle(patient.Id, donor.Id, RequestCancelled)
+			r = tx.requests.open(patient.Id, donor.Id, "", 0)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Id != want {
+			t.Errorf("request id %d, want %d", r.Id, want)
+		}
+	}
+	if store.hospital.NextRequestId != 10 {
+		t.Errorf("next request id %d, want 10", store.hospital.NextRequestId)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+)
+
+//maxSelectorDraws bounds the codes drawn for one credential. with 40 bit
+//selectors running out means the store is full or something is badly wrong
+const maxSelectorDraws = 32
+
+//issueSecretCode generates a secret code and hands its credential to store.
+//a new code is drawn while its selector is already taken. ErrSelectorTaken is
+//only returned when maxSelectorDraws codes in a row were taken
+func issueSecretCode(store func(cred SecretCredential) error) (string, error) {
+	for attempt := 1; ; attempt++ {
+		code, cred, err := newSecretCode()
+		if err != nil {
+			return "", err
+		}
+		err = store(cred)
+		if err == ErrSelectorTaken && attempt < maxSelectorDraws {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		return code, nil
+	}
+}
+
+type secretCodeData struct {
+	UserId         int    `json:"user_id"`
+	UserSecretCode string `json:"user_secret_code,omitempty"`
+	//VerificationCode replaces the secret code of a revoked user until the
+	//user exchanges it at /users/verify
+	VerificationCode string `json:"verification_code,omitempty"`
+}
+
+// POST /user/{id}/secret
+//rotateSecret replaces the caller's secret code. the old code stops working
+//and every session, including the one used for this call, is invalidated
+func (h *usersHandler) rotateSecret(w http.ResponseWriter, r *http.Request, t string) {
+	userId, err := strconv.Atoi(t)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("err: invalid User id. Check Input UserId")))
+		return
+	}
+
+	code, err := issueSecretCode(func(cred SecretCredential) error {
+		return h.store.ReplaceCredential(audited(r), EventRotateSecret, userId, cred)
+	})
+	if err != nil {
+		writeStoreError(w, err, "UserId")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, secretCodeData{
+		UserId:         userId,
+		UserSecretCode: code,
+	})
+}
+
+//revokeSecret invalidates the secret code and sessions of the user with id t.
+//the user is given a one-time verification code instead, which an admin
+//passes on once the user is verified out of band. it cannot be used to log in
+func (h *usersHandler) revokeSecret(w http.ResponseWriter, r *http.Request, t string) {
+	userId, err := strconv.Atoi(t)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("err: invalid User id. Check Input UserId")))
+		return
+	}
+
+	code, err := issueSecretCode(func(cred SecretCredential) error {
+		cred.Revoked = true
+		return h.store.ReplaceCredential(audited(r), EventRevokeSecret, userId, cred)
+	})
+	if err != nil {
+		writeStoreError(w, err, "UserId")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, secretCodeData{
+		UserId:           userId,
+		VerificationCode: code,
+	})
+}
+
+// POST /users/verify
+//verifySecret exchanges the verification code of a revoked user for a new secret code
+func (h *usersHandler) verifySecret(w http.ResponseWriter, r *http.Request) {
+	//verification codes are guessed like secret codes, so they share the throttle
+	attempt, ok := h.throttleAllows(w, r)
+	if !ok {
+		return
+	}
+	defer attempt.done()
+
+	bodyBytes, err := ioutil.ReadAll(r.Body)
+	defer r.Body.Close()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	var body struct {
+		VerificationCode string `json:"verification_code"`
+	}
+	if err := json.Unmarshal(bodyBytes, &body); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	config, err := h.store.VerifySecretCode(body.VerificationCode)
+	if err != nil || !config.Revoked {
+		loginFailures.Add(1)
+		attempt.failed()
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(fmt.Sprintf("err: No pending verification found. Check verification code value")))
+		return
+	}
+
+	//there is no session yet, the user verifies itself
+	by := audited(r)
+	by.ActorId, by.ActorType = config.Id, config.Type
+	code, err := issueSecretCode(func(cred SecretCredential) error {
+		return h.store.ReplaceCredential(by, EventVerifySecret, config.Id, cred)
+	})
+	if err != nil {
+		writeStoreError(w, err, "UserId")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, secretCodeData{
+		UserId:         config.Id,
+		UserSecretCode: code,
+	})
+}
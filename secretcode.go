@@ -0,0 +1,112 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"strings"
+)
+
+//a secret code is 24 base32 characters shown in groups of four, e.g.
+//K7QF-2MZA-PXRT-4LHE-Q9WD-7BNC. the first two groups, 40 bits, are the
+//selector the credential is stored under, the whole code is only ever stored
+//as a salted hash
+const (
+	secretCodeGroups         = 6
+	secretCodeGroupSize      = 4
+	secretCodeSelectorGroups = 2
+	saltBytes                = 16
+)
+
+const selectorLength = secretCodeSelectorGroups * secretCodeGroupSize
+
+var ErrBadSecretCode = errors.New("malformed secret code")
+
+//SecretCredential is everything the store keeps of a secret code
+type SecretCredential struct {
+	Selector       string `json:"selector"`
+	Salt           string `json:"salt"`
+	Hash           string `json:"hash"`
+	SessionVersion int    `json:"session_version,omitempty"`
+	Revoked        bool   `json:"revoked,omitempty"`
+}
+
+//newSecretCode generates a code from crypto/rand and the credential to store for it
+func newSecretCode() (string, SecretCredential, error) {
+	//15 random bytes are exactly 24 base32 characters
+	raw := make([]byte, secretCodeGroups*secretCodeGroupSize*5/8)
+	if _, err := rand.Read(raw); err != nil {
+		return "", SecretCredential{}, err
+	}
+	plain := base32.StdEncoding.EncodeToString(raw)
+
+	groups := make([]string, 0, secretCodeGroups)
+	for i := 0; i < len(plain); i += secretCodeGroupSize {
+		groups = append(groups, plain[i:i+secretCodeGroupSize])
+	}
+	code := strings.Join(groups, "-")
+
+	cred, err := hashSecretCode(plain[:selectorLength], plain)
+	return code, cred, err
+}
+
+//hashSecretCode salts and hashes code for storage under selector
+func hashSecretCode(selector string, code string) (SecretCredential, error) {
+	salt := make([]byte, saltBytes)
+	if _, err := rand.Read(salt); err != nil {
+		return SecretCredential{}, err
+	}
+	return SecretCredential{
+		Selector: selector,
+		Salt:     hex.EncodeToString(salt),
+		Hash:     secretHash(salt, code),
+	}, nil
+}
+
+func secretHash(salt []byte, code string) string {
+	sum := sha256.Sum256(append(append([]byte(nil), salt...), code...))
+	return hex.EncodeToString(sum[:])
+}
+
+//parseSecretCode normalizes what a user typed and returns the selector to look
+//the credential up by and the code to verify against it
+func parseSecretCode(input string) (string, string, error) {
+	code := strings.ToUpper(input)
+	code = strings.NewReplacer("-", "", " ", "").Replace(code)
+
+	if len(code) != secretCodeGroups*secretCodeGroupSize {
+		return "", "", ErrBadSecretCode
+	}
+	if _, err := base32.StdEncoding.DecodeString(code); err != nil {
+		return "", "", ErrBadSecretCode
+	}
+	return code[:selectorLength], code, nil
+}
+
+//verify reports whether code matches the credential, in constant time
+func (c UserProtected) verify(code string) bool {
+	salt, err := hex.DecodeString(c.Salt)
+	if err != nil || c.Hash == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(secretHash(salt, code)), []byte(c.Hash)) == 1
+}
+
+//putCredential registers cred for the user with id, replacing any older one
+func (hs *Hospital) putCredential(id int, t UserType, cred SecretCredential) {
+	if old, ok := hs.IdsToSelectors[id]; ok {
+		delete(hs.Credentials, old)
+	}
+	hs.Credentials[cred.Selector] = UserProtected{
+		Id:             id,
+		Type:           t,
+		Salt:           cred.Salt,
+		Hash:           cred.Hash,
+		SessionVersion: cred.SessionVersion,
+		Revoked:        cred.Revoked,
+	}
+	hs.IdsToSelectors[id] = cred.Selector
+}
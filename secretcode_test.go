@@ -0,0 +1,70 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSecretCodeRoundTrip(t *testing.T) {
+	code, cred, err := newSecretCode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if groups := strings.Split(code, "-"); len(groups) != secretCodeGroups {
+		t.Fatalf("code %s has %d groups, want %d", code, len(groups), secretCodeGroups)
+	}
+
+	for _, typed := range []string{code, strings.ToLower(code), strings.ReplaceAll(code, "-", " ")} {
+		selector, plain, err := parseSecretCode(typed)
+		if err != nil {
+			t.Fatalf("%q: %v", typed, err)
+		}
+		if selector != cred.Selector || len(selector) != selectorLength {
+			t.Errorf("%q: selector %q, want %q", typed, selector, cred.Selector)
+		}
+		if !(UserProtected{Salt: cred.Salt, Hash: cred.Hash}).verify(plain) {
+			t.Errorf("%q does not verify against its credential", typed)
+		}
+	}
+
+	for _, typed := range []string{"", "1234", code[:len(code)-1], code + "A", strings.Replace(code, code[:1], "1", 1)} {
+		if _, _, err := parseSecretCode(typed); err != ErrBadSecretCode {
+			t.Errorf("%q: got %v, want %v", typed, err, ErrBadSecretCode)
+		}
+	}
+}
+
+func TestIssueSecretCodeRetriesTakenSelectors(t *testing.T) {
+	tests := []struct {
+		taken   int //draws refused before one is accepted
+		wantErr error
+	}{
+		{0, nil},
+		{1, nil},
+		{maxSelectorDraws - 1, nil},
+		{maxSelectorDraws, ErrSelectorTaken},
+	}
+	for _, tt := range tests {
+		draws := 0
+		code, err := issueSecretCode(func(cred SecretCredential) error {
+			draws++
+			if draws <= tt.taken {
+				return ErrSelectorTaken
+			}
+			return nil
+		})
+		if err != tt.wantErr {
+			t.Errorf("%d taken: got %v, want %v", tt.taken, err, tt.wantErr)
+		}
+		if err == nil && code == "" {
+			t.Errorf("%d taken: no code issued", tt.taken)
+		}
+		want := tt.taken + 1
+		if want > maxSelectorDraws {
+			want = maxSelectorDraws
+		}
+		if draws != want {
+			t.Errorf("%d taken: %d draws, want %d", tt.taken, draws, want)
+		}
+	}
+}
@@ -2,13 +2,14 @@ package main
 
 import (
 	"encoding/json"
+	"flag"
 	"fmt"
 	"io/ioutil"
-	"math/rand"
+	"math"
 	"net/http"
+	"os"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 )
 
@@ -17,6 +18,8 @@ type UserType int
 const (
  	Patient UserType = iota
     Donor
+	Staff //hospital coordinators, only reachable through /admin/
+	Admin //staff that may also manage other staff
 )
 
 type Hospital struct {
@@ -25,8 +28,19 @@ type Hospital struct {
 	TotalDonors      int                   `json:"total_donors"`
 	Patients         map[int]User          `json:"patients"`
 	Donors           map[int]User          `json:"donors"`
-	SecretCodesToIds map[int]UserProtected `json:"secret_codes"`
-	IdsToSecretCodes map[int]int `json:"ids_to_secret_codes"`
+	Credentials      map[string]UserProtected `json:"credentials"` //map[selector] = hashed secret code of a user
+	IdsToSelectors   map[int]string `json:"ids_to_selectors"`
+	Seq              uint64      `json:"seq"` //last journal event folded into the store
+	NextId           int         `json:"next_id"` //next user id, ids are never reused
+	NextRequestId    int         `json:"next_request_id"` //next request id, never reused either
+	Staff            map[int]StaffMember `json:"staff"` //ids come from the same sequence as users
+	Connections      map[string]Connection `json:"connections"` //map[donorId-patientId], one for every connected edge
+	Broadcasts       map[int]Broadcast     `json:"broadcasts"`
+	Requests         map[int]Request       `json:"requests"` //the pending ones each have a requested edge
+	Graph            *Graph                `json:"graph"` //relationships between users, their ids in User are produced from it
+	Notifications    map[int]Notification  `json:"notifications"`
+	AuditSeq         int                   `json:"audit_seq"` //last entry of the audit trail, so a trail cut short is noticed
+	AuditHead        string                `json:"audit_head"` //and its hash
 }
 
 type User struct {
@@ -34,57 +48,105 @@ type User struct {
 	Name              string   `json:"name"`
 	Address           string   `json:"address"`
 	PhoneNo           string   `json:"phone_no"`
+	Location          *Location `json:"location,omitempty"` //given at signup or geocoded from Address
 	Type              UserType `json:"type"`
 	DiseaseDesc       string   `json:"disease_desc,omitempty"`
+	BloodGroup        BloodGroup `json:"blood_group,omitempty"` //empty only for users that signed up before it was required
+	//relationship ids, produced from Hospital.Graph on output and never stored
 	RequestedUserIds  []int    `json:"requested_user_ids"`
 	PendingUserIds    []int    `json:"pending_user_ids"`
 	ConnectedUsersIds []int    `json:"connected_users_ids"`
+	BlockedUserIds    []int    `json:"blocked_user_ids,omitempty"` //users whose requests were declined for good
+	Deactivated       bool     `json:"deactivated,omitempty"` //set by staff, the user can no longer log in or be requested
+	//donors only
+	Unavailable       bool     `json:"unavailable,omitempty"` //set by the donor while it cannot donate
+	DateOfBirth       string   `json:"date_of_birth,omitempty"` //YYYY-MM-DD
+	WeightKg          float64  `json:"weight_kg,omitempty"`
+	LastDonation      string   `json:"last_donation,omitempty"` //YYYY-MM-DD
+	LastDonationKind  string   `json:"last_donation_kind,omitempty"` //whole_blood when empty
+	Deferrals         []Deferral `json:"deferrals,omitempty"`
+	OfferedTypes      []string `json:"offered_types,omitempty"` //donors, ids of donationTypes. whole_blood when empty
+	NeededTypes       []string `json:"needed_types,omitempty"` //patients, likewise
+	HLA               *HLATyping `json:"hla,omitempty"`
+	RegisteredAt      time.Time `json:"registered_at"` //zero for users that signed up before it was recorded
+	//patients only, set by staff
+	Urgency           string   `json:"urgency,omitempty"` //routine when empty
+	RequiredBy        string   `json:"required_by,omitempty"` //YYYY-MM-DD
+	RequestsReceived  int      `json:"requests_received,omitempty"` //requests from patients, cancelled ones are not counted
+	RequestsAnswered  int      `json:"requests_answered,omitempty"` //of those, how many the donor accepted
 }
 
 type UserProtected struct {
 	Id   int 	  `json:"id,omitempty"`
 	Type UserType `json:"type,omitempty"`
+	Salt string   `json:"salt,omitempty"`
+	Hash string   `json:"hash,omitempty"` //sha256 of salt and secret code
+	SessionVersion int `json:"session_version,omitempty"` //sessions issued under an older version are invalid
+	Revoked        bool `json:"revoked,omitempty"` //the code is a verification code handed out by an admin, not a login
 }
 
 //declaring store struct
 type usersHandler struct{
-	sync.Mutex
-	store Hospital
+	store Store
+	sessions *sessions
+	throttle *loginThrottle
+	auditLog *auditLog
+	bloodCheck string //one of the bloodCheck modes
+	geocoder Geocoder //nil when addresses are not geocoded
+	rules eligibilityRules
+	requestTTL time.Duration //0 keeps requests pending until answered
 }
 
-var seededRand *rand.Rand = rand.New(
-	rand.NewSource(time.Now().UnixNano()))
+//httpError is returned from store update funcs to answer with status and msg
+type httpError struct{
+	status int
+	msg    string
+}
+
+func (e *httpError) Error() string{
+	return e.msg
+}
+
+func emptyHospital() Hospital{
+	return Hospital{
+		Total: 0, 
+		TotalPatients: 0, 
+		TotalDonors: 0, 
+		Patients: map[int]User{}, 
+		Donors: map[int]User{}, 
+		Credentials: map[string]UserProtected{},
+		IdsToSelectors: map[int]string{},   //map[userId] = selector;
+		NextId: 1,
+		NextRequestId: 1,
+		Staff: map[int]StaffMember{},
+		Connections: map[string]Connection{},
+		Broadcasts: map[int]Broadcast{},
+		Graph: newGraph(),
+		Requests: map[int]Request{},
+		Notifications: map[int]Notification{},
+	}
+}
 
 //creating store
-func newUsersHandler()*usersHandler{
+func newUsersHandler(store Store, sessions *sessions, auditLog *auditLog)*usersHandler{
 	return &usersHandler{
-		Mutex: sync.Mutex{},
-		store: Hospital{
-			Total: 0, 
-			TotalPatients: 0, 
-			TotalDonors: 0, 
-			Patients: map[int]User{}, 
-			Donors: map[int]User{}, 
-			SecretCodesToIds: map[int]UserProtected{},
-			IdsToSecretCodes: map[int]int{},   //map[secret_code] = userId;
-		},
+		store: store,
+		sessions: sessions,
+		throttle: newLoginThrottle(),
+		auditLog: auditLog,
+		bloodCheck: bloodCheckReject,
+		rules: defaultEligibilityRules(),
 	}
 }
 
-//helper func
-func removeDuplicates(arr []int) []int {
-    occured := map[int]bool{}
-    result := []int{}
-    for e := range arr {
-        if occured[arr[e]] != true {
-            occured[arr[e]] = true
-            result = append(result, arr[e])
-        }
-    }
-  
-    return result
+//routes registers the handlers of h on mux
+func (h *usersHandler) routes(mux *http.ServeMux){
+	mux.HandleFunc("/users/", h.users);
+	mux.HandleFunc("/user/",h.requireSession(h.user));
+	mux.HandleFunc("/admin/", h.admin);
 }
 
+//helper func
 func find(a []int, x int) int {
 	for i, n := range a {
 			if x == n {
@@ -94,14 +156,164 @@ func find(a []int, x int) int {
 	return -1
 }
 
-func removeElementByIndex(s []int, index int) []int {
-	return append(s[:index], s[index+1:]...)
+func typeName(t UserType) string {
+	if t == Donor {
+		return "Donor"
+	}
+	return "Patient"
+}
+
+func otherType(t UserType) UserType {
+	if t == Donor {
+		return Patient
+	}
+	return Donor
+}
+
+//readOptionalBody decodes the json body of r into v, leaving v as it is when
+//the body is empty. on failure the answer is written to w
+func readOptionalBody(w http.ResponseWriter, r *http.Request, v interface{}) bool{
+	bodyBytes, err := ioutil.ReadAll(r.Body)
+	defer r.Body.Close()
+	if err != nil{
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return false
+	}
+	if len(bodyBytes) > 0{
+		if err := json.Unmarshal(bodyBytes, v); err != nil{
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return false
+		}
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}){
+	jsonBytes, err := json.Marshal(v)
+	if err!=nil{
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	w.Header().Add("content-type", "application/json")
+	w.WriteHeader(status)
+	w.Write((jsonBytes))
+}
+
+//writeStoreError answers with the status matching err. idName names the id
+//the lookup was made with, e.g. UserId or RequestId
+func writeStoreError(w http.ResponseWriter, err error, idName string){
+	switch e := err.(type){
+	case *httpError:
+		w.WriteHeader(e.status)
+		w.Write([]byte(e.msg))
+		return
+	}
+
+	switch err{
+	case ErrUserNotFound:
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(fmt.Sprintf("err: User Not Found. Check Input %s", idName)))
+	case ErrCodeMismatch:
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(fmt.Sprintf("err: Something is wrong! %s and Secret Code Mismatched. Contact Admin", idName)))
+	case ErrBroadcastNotFound:
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(fmt.Sprintf("err: Broadcast Not Found. Check Input %s", idName)))
+	case ErrSelectorTaken:
+		w.Header().Set("Retry-After", "1")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(fmt.Sprintf("err: could not issue a secret code. Try again")))
+	case ErrUserConflict:
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte(fmt.Sprintf("err: %s is registered as both a patient and a donor", idName)))
+	default:
+		fmt.Println("store error:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(fmt.Sprintf("err: could not persist store. Contact Admin")))
+	}
+}
+
+//parseUserPair reads the user and request ids of /user/{id}/request/{id}
+//and makes sure both users exist
+func (h *usersHandler) parseUserPair(w http.ResponseWriter, t string, p string) (User, User, bool){
+	userId, err := strconv.Atoi(t);
+	if err != nil{
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("err: invalid User id. Check Input UserId")))
+		return User{}, User{}, false
+	}
+
+	currUser, err := h.store.GetUser(userId)
+	if err != nil{
+		writeStoreError(w, err, "UserId")
+		return User{}, User{}, false
+	}
+
+	requestId, err := strconv.Atoi(p);
+	if err != nil{
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("err: invalid Request id. Check request Id")))
+		return User{}, User{}, false
+	}
+
+	requestUser, err := h.store.GetUser(requestId)
+	if err != nil{
+		writeStoreError(w, err, "RequestId")
+		return User{}, User{}, false
+	}
+
+	return currUser, requestUser, true
+}
+
+//checkRequest decides whether sender may send a request to recipient. it
+//returns a warning for the response, or an httpError when the request is refused
+func (h *usersHandler) checkRequest(links *linkBook, sender User, recipient User) (string, error){
+	if recipient.Type == sender.Type || recipient.Deactivated{
+		return "", &httpError{http.StatusNotFound, fmt.Sprintf("err: Check Input UserId %sId : %d NOT FOUND", typeName(otherType(sender.Type)), recipient.Id)}
+	}
+	if links.has(EdgeBlocked, recipient.Id, sender.Id){
+		return "", &httpError{http.StatusForbidden, fmt.Sprintf("err: %sId : %d does not accept requests from you", typeName(recipient.Type), recipient.Id)}
+	}
+	if _, err := checkTypes(donorAndPatient(sender, recipient)); err != nil{
+		return "", err
+	}
+	warning, err := h.checkBlood(sender, recipient)
+	if err != nil{
+		return "", err
+	}
+	if err := h.checkEligible(sender, recipient); err != nil{
+		return "", err
+	}
+	return warning, nil
+}
+
+//addRequest opens a request from sender to recipient
+func (h *usersHandler) addRequest(requests *requestBook, sender *User, recipient *User, message string) Request{
+	if recipient.Type == Donor{
+		recipient.RequestsReceived += 1
+	}
+	return requests.open(sender.Id, recipient.Id, message, h.requestTTL)
+}
+
+//dropRequest cancels the pending request from sender to recipient, reporting whether there was one
+func dropRequest(requests *requestBook, sender *User, recipient *User) bool{
+	if !requests.settle(sender.Id, recipient.Id, RequestCancelled){
+		return false
+	}
+	if recipient.Type == Donor && recipient.RequestsReceived > 0{
+		recipient.RequestsReceived -= 1
+	}
+	return true
 }
 
 //api routes func
 // /users/
 func (h *usersHandler) users(w http.ResponseWriter, r *http.Request){
-	parts := strings.Split(r.URL.String(), "/");
+	parts := strings.Split(r.URL.Path, "/");
 	path := parts[2];
 	
 	switch r.Method{
@@ -109,19 +321,26 @@ func (h *usersHandler) users(w http.ResponseWriter, r *http.Request){
 		case "GET":
 				switch path{
 				case "login":
-					if(len(parts)<4){
-						w.WriteHeader(http.StatusBadRequest);
-						w.Write([]byte(fmt.Sprintf("err:  check if secret code given with login/{:secret_code}")))
-						return;
-					}
-					h.login(w,r,parts[3])
+					//secret codes in urls end up in access logs
+					w.WriteHeader(http.StatusMethodNotAllowed);
+					w.Write([]byte(fmt.Sprintf("err:  send the secret code as POST /users/login with {\"secret_code\": ...}")))
 					return;		
 				
 				case "donors":
+					if r.URL.Query().Get("near") != ""{
+						h.getDonorsNear(w,r);
+						return;
+					}
 					h.getAll(w,r,"d");
 				
 				case "patients":
-					h.getAll(w,r,"p");
+					h.requireSession(func(w http.ResponseWriter, r *http.Request){
+						h.getAll(w,r,"p");
+					})(w,r);
+					return;
+
+				case "donation-types":
+					h.getDonationTypes(w,r);
 					return;
 				
 				default:
@@ -136,6 +355,14 @@ func (h *usersHandler) users(w http.ResponseWriter, r *http.Request){
 				case "signup":
 					h.signup(w,r);
 					return;
+
+				case "login":
+					h.login(w,r);
+					return;
+
+				case "verify":
+					h.verifySecret(w,r);
+					return;
 					
 				default:
 					w.WriteHeader(http.StatusBadRequest);
@@ -153,7 +380,7 @@ func (h *usersHandler) users(w http.ResponseWriter, r *http.Request){
 
 // /user/{id}
 func (h *usersHandler) user(w http.ResponseWriter, r *http.Request){
-	parts := strings.Split(r.URL.String(), "/");
+	parts := strings.Split(r.URL.Path, "/");
 	partsLen := len(parts);
 
 	if partsLen < 3 {
@@ -162,7 +389,54 @@ func (h *usersHandler) user(w http.ResponseWriter, r *http.Request){
 		return;
 	} 
 
+	//every action under /user/{id} is taken as {id}
+	if !ownsUser(w, r, parts[2]){
+		return
+	}
+
 	switch partsLen{
+	case 4:
+		switch{
+			// /user/{id}/secret
+		case parts[3] == "secret" && r.Method == "POST":
+			h.rotateSecret(w,r,parts[2])
+			return
+
+			// /user/{id}/matches
+		case parts[3] == "matches" && r.Method == "GET":
+			h.getMatches(w,r,parts[2])
+			return
+
+			// /user/{id}/requests
+		case parts[3] == "requests" && r.Method == "GET":
+			h.getRequests(w,r,parts[2])
+			return
+
+			// /user/{id}/notifications
+		case parts[3] == "notifications" && r.Method == "GET":
+			h.getNotifications(w,r,parts[2])
+			return
+
+			// /user/{id}/connections
+		case parts[3] == "connections" && r.Method == "GET":
+			h.getConnections(w,r,parts[2])
+			return
+
+			// /user/{id}/broadcast
+		case parts[3] == "broadcast" && r.Method == "POST":
+			h.createBroadcast(w,r,parts[2])
+			return
+
+		case parts[3] == "broadcast" && r.Method == "GET":
+			h.getBroadcasts(w,r,parts[2])
+			return
+
+		default:
+			w.WriteHeader(http.StatusBadRequest);
+			w.Write([]byte(fmt.Sprintf("err:  check request url path")))
+			return;
+		}
+
 	case 3:
 		switch r.Method{
 			// /user/{id}
@@ -185,6 +459,11 @@ func (h *usersHandler) user(w http.ResponseWriter, r *http.Request){
 		}
 			
 	case 5:
+		// /user/{id}/broadcast/{id}
+		if parts[3] == "broadcast" && r.Method == "DELETE"{
+			h.closeBroadcast(w,r, parts[2], parts[4])
+			return
+		}
 		if(parts[3] != "request"){
 			w.WriteHeader(http.StatusBadRequest);
 			w.Write([]byte(fmt.Sprintf("err:  check request url path")))
@@ -210,6 +489,14 @@ func (h *usersHandler) user(w http.ResponseWriter, r *http.Request){
 			h.cancelConnection(w,r, parts[2], parts[4])
 			return
 
+		case "DECLINE":
+			h.declineRequest(w,r, parts[2], parts[4])
+			return
+
+		case "UNBLOCK":
+			h.unblockUser(w,r, parts[2], parts[4])
+			return
+
 		default:
 			w.WriteHeader(http.StatusBadRequest);
 			w.Write([]byte(fmt.Sprintf("err:  check request url path")))
@@ -224,131 +511,185 @@ func (h *usersHandler) user(w http.ResponseWriter, r *http.Request){
 }
 
 //api actions
-func (h *usersHandler) login(w http.ResponseWriter, r *http.Request, secretCode string){
-	code, err := strconv.Atoi(secretCode);
-	fmt.Println(code);
+//throttleAllows counts an attempt to guess a code from the client of r and
+//reserves it with the login throttle, answering 429 if it is refused. the
+//caller has to settle the attempt
+func (h *usersHandler) throttleAllows(w http.ResponseWriter, r *http.Request) (*loginAttempt, bool){
+	loginAttempts.Add(1)
+
+	attempt, wait := h.throttle.allow(clientIp(r))
+	if attempt == nil{
+		loginThrottled.Add(1)
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write([]byte(fmt.Sprintf("err: Too many login attempts. Try again later")))
+		return nil, false
+	}
+	return attempt, true
+}
 
-	if(err != nil){
-		w.WriteHeader(http.StatusNotFound);
-		w.Write([]byte(fmt.Sprintf("err: Invalid Secret Code. Check secret code value")))
-		return;
+//checkSecretCode reads {"secret_code": ...} from the body of r and verifies it
+//under the login throttle. codes of other than the allowed types are treated
+//as unknown. on failure the answer is written to w
+func (h *usersHandler) checkSecretCode(w http.ResponseWriter, r *http.Request, allowed ...UserType) (UserProtected, bool){
+	attempt, ok := h.throttleAllows(w, r)
+	if !ok{
+		return UserProtected{}, false
 	}
+	defer attempt.done()
 
-	h.Lock()
-		userDetails,status := h.store.SecretCodesToIds[code];
-	h.Unlock()
+	bodyBytes, err := ioutil.ReadAll(r.Body)
+	defer r.Body.Close();
+	if err != nil{
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return UserProtected{}, false
+	}
 
-	fmt.Println(userDetails);
-	fmt.Println(rand.Int());
-	fmt.Println(rand.Int());
+	var body struct{
+		SecretCode string `json:"secret_code"`
+	}
+	if e := json.Unmarshal(bodyBytes, &body); e != nil{
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(e.Error()))
+		return UserProtected{}, false
+	}
 
-	if(!status){
+	userDetails, err := h.store.VerifySecretCode(body.SecretCode)
+	if err == nil{
+		err = ErrUnknownSecret
+		for _, t := range allowed{
+			if userDetails.Type == t{
+				err = nil
+			}
+		}
+	}
+	if err != nil{
+		loginFailures.Add(1)
+		attempt.failed()
+	}
+	if(err == ErrBadSecretCode){
+		w.WriteHeader(http.StatusNotFound);
+		w.Write([]byte(fmt.Sprintf("err: Invalid Secret Code. Check secret code value")))
+		return UserProtected{}, false;
+	}
+	if(err != nil){
 		w.WriteHeader(http.StatusNotFound);
 		w.Write([]byte(fmt.Sprintf("err: No user details found. Check secret code value")))
-		return;
+		return UserProtected{}, false;
+	}
+	if(userDetails.Revoked){
+		w.WriteHeader(http.StatusForbidden);
+		w.Write([]byte(fmt.Sprintf("err: Secret code revoked. Exchange the verification code from the admin at /users/verify")))
+		return UserProtected{}, false;
 	}
+	return userDetails, true
+}
 
-	switch(userDetails.Type){
-		case Patient:
-			h.Lock()
-				patient, status := h.store.Patients[userDetails.Id];
-			h.Unlock()
+func (h *usersHandler) login(w http.ResponseWriter, r *http.Request){
+	//staff log in at /admin/login
+	userDetails, ok := h.checkSecretCode(w, r, Patient, Donor)
+	if !ok{
+		return
+	}
 
-			fmt.Println(status);
+	user, err := h.store.GetUser(userDetails.Id)
+	if(err != nil){
+		w.WriteHeader(http.StatusInternalServerError);
+		w.Write([]byte(fmt.Sprintf("err:  User Not Found. Check secret code value")))
+		return;
+	}
 
-			if(!status){
-				w.WriteHeader(http.StatusInternalServerError);
-				w.Write([]byte(fmt.Sprintf("err:  User Not Found. Check secret code value")))
-				return;
-			}
-			
-			fmt.Println(patient);
+	if user.Deactivated{
+		w.WriteHeader(http.StatusForbidden);
+		w.Write([]byte(fmt.Sprintf("err: Account deactivated. Contact Admin")))
+		return;
+	}
 
-			jsonBytes, e := json.Marshal(patient)
-			if e !=nil{
-				w.WriteHeader(http.StatusInternalServerError)
-				w.Write([]byte(e.Error()))
-				return
-			}
+	token, expires, err := h.sessions.issue(userDetails)
+	if err != nil{
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
 
-			w.Header().Add("content-type", "application/json")
-			w.WriteHeader(http.StatusOK)
-			w.Write((jsonBytes))
-			return;
-		
-		case Donor:
-			h.Lock()
-				donor, status := h.store.Donors[userDetails.Id];
-			h.Unlock()
-
-			if(!status){
-				w.WriteHeader(http.StatusInternalServerError);
-				w.Write([]byte(fmt.Sprintf("err:  User Not Found. Check secret code value")))
-				return;
-			}
-			
-			fmt.Println(donor);
+	type Data struct {
+		UserInfo  User      `json:"user_data"`
+		Token     string    `json:"token"` //send as Authorization: Bearer {token} on /user/ actions
+		ExpiresAt time.Time `json:"expires_at"`
+	}
 
-			jsonBytes, e := json.Marshal(donor)
-			if e !=nil{
-				w.WriteHeader(http.StatusInternalServerError)
-				w.Write([]byte(e.Error()))
-				return
-			}
+	writeJSON(w, http.StatusOK, Data{
+		UserInfo: user,
+		Token: token,
+		ExpiresAt: expires,
+	})
+}
 
-			w.Header().Add("content-type", "application/json")
-			w.WriteHeader(http.StatusOK)
-			w.Write((jsonBytes))
-			return;
+//activeUsers drops the users staff deactivated
+func activeUsers(users []User) []User{
+	active := make([]User, 0, len(users))
+	for _, user := range users{
+		if !user.Deactivated{
+			active = append(active, user)
 		}
+	}
+	return active
 }
 
 //get all donors or patients
 func (h *usersHandler) getAll(w http.ResponseWriter, r *http.Request,t string){
 	switch(t){
 	case "d":
-		donors := make([]User, h.store.TotalDonors);
-		h.Lock()
-		i := 0
-		for _, donor := range h.store.Donors{
-			donors[i] = donor
-			i++
-		}
-		h.Unlock()
-
-		jsonBytes, err := json.Marshal(donors)
-		if err!=nil{
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte(err.Error()))
-			return
-		}
-
-		w.Header().Add("content-type", "application/json")
-		w.WriteHeader(http.StatusOK)
-		w.Write((jsonBytes))
-		return;
-	
+		writeJSON(w, http.StatusOK, h.listDonors(activeUsers(h.store.ListUsers(Donor))))
 	case "p":
-		patients := make([]User, h.store.TotalPatients);
-		h.Lock()
-		i := 0
-		for _, patient := range h.store.Patients{
-			patients[i] = patient
-			i++
-		}
-		h.Unlock()
+		//most urgent first, so donors see critical cases at the top
+		patients := activeUsers(h.store.ListUsers(Patient))
+		sortByPriority(patients)
+		writeJSON(w, http.StatusOK, listPatients(patients))
+	}
+}
 
-		jsonBytes, err := json.Marshal(patients)
-		if err!=nil{
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte(err.Error()))
-			return
-		}
+//signupForm is what a user may give about itself at signup. everything else
+//in User, like urgency, deactivation or the response counters, is set by
+//staff or by the server and can not come from the client
+type signupForm struct {
+	Name             string     `json:"name"`
+	Address          string     `json:"address"`
+	PhoneNo          string     `json:"phone_no"`
+	Location         *Location  `json:"location"`
+	Type             UserType   `json:"type"`
+	DiseaseDesc      string     `json:"disease_desc"`
+	BloodGroup       BloodGroup `json:"blood_group"`
+	Unavailable      bool       `json:"unavailable"`
+	DateOfBirth      string     `json:"date_of_birth"`
+	WeightKg         float64    `json:"weight_kg"`
+	LastDonation     string     `json:"last_donation"`
+	LastDonationKind string     `json:"last_donation_kind"`
+	Deferrals        []Deferral `json:"deferrals"`
+	OfferedTypes     []string   `json:"offered_types"`
+	NeededTypes      []string   `json:"needed_types"`
+	HLA              *HLATyping `json:"hla"`
+}
 
-		w.Header().Add("content-type", "application/json")
-		w.WriteHeader(http.StatusOK)
-		w.Write((jsonBytes))
-		return;
+func (f signupForm) user() User{
+	return User{
+		Name: f.Name,
+		Address: f.Address,
+		PhoneNo: f.PhoneNo,
+		Location: f.Location,
+		Type: f.Type,
+		DiseaseDesc: f.DiseaseDesc,
+		BloodGroup: f.BloodGroup,
+		Unavailable: f.Unavailable,
+		DateOfBirth: f.DateOfBirth,
+		WeightKg: f.WeightKg,
+		LastDonation: f.LastDonation,
+		LastDonationKind: f.LastDonationKind,
+		Deferrals: f.Deferrals,
+		OfferedTypes: f.OfferedTypes,
+		NeededTypes: f.NeededTypes,
+		HLA: f.HLA,
 	}
 }
 
@@ -367,16 +708,18 @@ func (h *usersHandler) signup(w http.ResponseWriter, r *http.Request){
 	if ct != "application/json"{
 		w.WriteHeader(http.StatusUnsupportedMediaType)
 		w.Write([]byte(fmt.Sprintf("err:  required content-type: application/json but got '%s'", ct)))
+		return
 	}
 
-	var user User
-	e := json.Unmarshal(bodyBytes, &user)
+	var form signupForm
+	e := json.Unmarshal(bodyBytes, &form)
 
 	if e != nil{
 		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(err.Error()))
+		w.Write([]byte(e.Error()))
 		return 
 	}
+	user := form.user()
 
 	if user.Name == ""{
 		w.WriteHeader(http.StatusUnprocessableEntity)
@@ -403,40 +746,65 @@ func (h *usersHandler) signup(w http.ResponseWriter, r *http.Request){
 		return
 	}
 
-	h.Lock()
-	defer h.Unlock();
+	if user.BloodGroup, err = parseBloodGroup(string(user.BloodGroup)); err != nil{
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		w.Write([]byte(err.Error()))
+		return
+	}
 
-	//adding to store
-	
-	h.store.Total += 1;
+	if e := h.validateDonorProfile(&user); e != nil{
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		w.Write([]byte(e.Error()))
+		return
+	}
 
-	if(user.Type == Donor){
-		h.store.TotalDonors += 1;
-		user.Id = h.store.Total;
-		fmt.Println(user);
-		h.store.Donors[user.Id] = user;
+	if user.HLA != nil{
+		if e := user.HLA.normalize(); e != nil{
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			w.Write([]byte(e.Error()))
+			return
+		}
 	}
 
-	if(user.Type == Patient){
-		h.store.TotalPatients += 1;
-		user.Id = h.store.Total;
-		fmt.Println(user);
-		h.store.Patients[user.Id] = user;
+	if user.Type == Donor{
+		user.NeededTypes = nil
+	} else{
+		user.OfferedTypes = nil
 	}
-		
-	fmt.Println("user stored");
-	
-	secretCode := rand.Int();
-	h.store.SecretCodesToIds[secretCode] = UserProtected{
-		Id: user.Id,
-		Type: user.Type,
-	};
+	if e := validateDonationTypes(user); e != nil{
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		w.Write([]byte(e.Error()))
+		return
+	}
+
+	if user.Location == nil{
+		user.Location = h.geocode(user.Address)
+	} else if !user.Location.valid(){
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		w.Write([]byte(fmt.Sprintf("err: location must be lat, lng in decimal degrees")))
+		return
+	}
+
+	user.RegisteredAt = time.Now().UTC()
 
-	h.store.IdsToSecretCodes[user.Id] = secretCode;
+	//adding to store
+	//the user signs itself up, its id is filled in by the store
+	by := audited(r)
+	by.ActorType = user.Type
+	secretCode, err := issueSecretCode(func(cred SecretCredential) error{
+		created, err := h.store.CreateUser(by, user, cred)
+		user = created
+		return err
+	})
+	if err != nil{
+		writeStoreError(w, err, "UserId")
+		return
+	}
+	fmt.Println("user stored");
 	
 	type Data struct {
 		UserInfo       User   `json:"user_data,omitempty"`
-		UserSecretCode int `json:"user_secret_code,omitempty"`
+		UserSecretCode string `json:"user_secret_code,omitempty"`
 	}
 
 	userData := Data{
@@ -445,19 +813,7 @@ func (h *usersHandler) signup(w http.ResponseWriter, r *http.Request){
 	}
 
 	//returning to server
-	jsonBytes, err := json.Marshal(userData)
-	jsonBytes = append(jsonBytes, )
-	if err!=nil{
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(err.Error()))
-		h.Unlock()
-		return
-	}
-
-	w.Header().Add("content-type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	w.Write((jsonBytes))
-	return;
+	writeJSON(w, http.StatusOK, userData)
 }
 
 //getUser
@@ -473,68 +829,19 @@ func (h *usersHandler) getUser(w http.ResponseWriter, r *http.Request,t string){
 	}
 
 	fmt.Println(userId);
-	
-	h.Lock();
-	userSecretCode, ok := h.store.IdsToSecretCodes[userId];
-	h.Unlock();
-	
-	if !ok{
-		w.WriteHeader(http.StatusNotFound)
-		w.Write([]byte(fmt.Sprintf("err: User Not Found. Check Input UserId")))
-		return
-	}
-	
-	h.Lock()
-	userConfig, ok := h.store.SecretCodesToIds[userSecretCode];
-	h.Unlock()
-	
-	if !ok{
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(fmt.Sprintf("err: UserId and Secret Code Mismatched. Contact Admin")))
-		return
-	}
-
-	if userConfig.Type == Patient{
-		h.Lock()
-		patient := h.store.Patients[userConfig.Id];
-		h.Unlock()
 
-		jsonBytes, err := json.Marshal(patient)
-	
-		if err!=nil{
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte(err.Error()))
-			return
-		}
-		w.Header().Add("content-type", "application/json")
-		w.WriteHeader(http.StatusOK)
-		w.Write((jsonBytes))
-		return;
+	user, err := h.store.GetUser(userId)
+	if err != nil{
+		writeStoreError(w, err, "UserId")
+		return
 	}
 
-	if userConfig.Type == Donor{
-		h.Lock()
-			donor := h.store.Donors[userConfig.Id];
-		h.Unlock()
-		
-		jsonBytes, err := json.Marshal(donor)
-	
-		if err!=nil{
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte(err.Error()))
-			return
-		}
-		w.Header().Add("content-type", "application/json")
-		w.WriteHeader(http.StatusOK)
-		w.Write((jsonBytes))
-		return;
-	}
+	writeJSON(w, http.StatusOK, user)
 }
 
 //updateUser 
 func (h *usersHandler) updateUserContact(w http.ResponseWriter, r *http.Request,t string){
 	println("You may only update contact Info")
-	println("update user started \n if no_updation found, please check your field names: \n phone_no \n address");
 
 	bodyBytes, err := ioutil.ReadAll(r.Body) //check body is valid
 	defer r.Body.Close()
@@ -549,6 +856,7 @@ func (h *usersHandler) updateUserContact(w http.ResponseWriter, r *http.Request,
 	if ct != "application/json"{
 		w.WriteHeader(http.StatusUnsupportedMediaType)
 		w.Write([]byte(fmt.Sprintf("err:  content-type: application/json but got '%s'", ct)))
+		return
 	}
 
 	userId, err := strconv.Atoi(t);
@@ -559,81 +867,122 @@ func (h *usersHandler) updateUserContact(w http.ResponseWriter, r *http.Request,
 	}
 
 	fmt.Println(userId);
-	
-	h.Lock();
-	userSecretCode, ok := h.store.IdsToSecretCodes[userId];
-	h.Unlock();
-	
-	if !ok{
-		w.WriteHeader(http.StatusNotFound)
-		w.Write([]byte(fmt.Sprintf("err: User Not Found. Check Input UserId")))
-		return
-	}
-	
-	h.Lock()
-	userConfig, ok := h.store.SecretCodesToIds[userSecretCode];
-	h.Unlock()
-
-	if !ok{
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(fmt.Sprintf("err: UserId and Secret Code Mismatched. Contact Admin")))
-		return;
-	}
 
 	var updateUser User;
 	e := json.Unmarshal(bodyBytes, &updateUser) //updated user info
 	if e != nil{
 		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(err.Error()))
+		w.Write([]byte(e.Error()))
 		return 
 	}
 
-	if userConfig.Type == Patient{
-		h.Lock()
-		currUser := h.store.Patients[userConfig.Id];
-		if(updateUser.Address != ""){
-			currUser.Address = updateUser.Address
-		}
-		if(updateUser.PhoneNo != ""){
-			currUser.PhoneNo = updateUser.PhoneNo
+	//bools and lists cannot tell empty from missing in User
+	var flags struct{
+		Unavailable *bool `json:"unavailable"`
+		Deferrals   *[]Deferral `json:"deferrals"`
+		OfferedTypes *[]string `json:"offered_types"`
+		NeededTypes  *[]string `json:"needed_types"`
+	}
+	json.Unmarshal(bodyBytes, &flags)
+
+	if e := h.validateDonorUpdate(updateUser, flags.Deferrals); e != nil{
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		w.Write([]byte(e.Error()))
+		return
+	}
+
+	if updateUser.HLA != nil{
+		if e := updateUser.HLA.normalize(); e != nil{
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			w.Write([]byte(e.Error()))
+			return
 		}
-		h.store.Patients[userConfig.Id] = currUser;
-		jsonBytes, err := json.Marshal(currUser)
-	
-		if err!=nil{
-			w.WriteHeader(http.StatusInternalServerError)
+	}
+
+	if updateUser.Location != nil && !updateUser.Location.valid(){
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		w.Write([]byte(fmt.Sprintf("err: location must be lat, lng in decimal degrees")))
+		return
+	}
+	//a new address without a location moves the user to wherever the
+	//address geocodes to, or to no location at all
+	if updateUser.Address != "" && updateUser.Location == nil{
+		updateUser.Location = h.geocode(updateUser.Address)
+	}
+
+	if updateUser.BloodGroup != ""{
+		if updateUser.BloodGroup, err = parseBloodGroup(string(updateUser.BloodGroup)); err != nil{
+			w.WriteHeader(http.StatusUnprocessableEntity)
 			w.Write([]byte(err.Error()))
-			h.Unlock()
 			return
 		}
-		w.Header().Add("content-type", "application/json")
-		w.Write((jsonBytes))
-		h.Unlock();
 	}
 
-	if userConfig.Type == Donor{
-		h.Lock()
-		currUser := h.store.Donors[userConfig.Id];
-		if(updateUser.Address != ""){
+	currUser, err := h.store.UpdateUser(audited(r), EventUpdateContact, userId, func(currUser *User) error{
+		//users that signed up before blood groups were required may add theirs once
+		if updateUser.BloodGroup != "" && updateUser.BloodGroup != currUser.BloodGroup{
+			if currUser.BloodGroup != ""{
+				return &httpError{http.StatusUnprocessableEntity, fmt.Sprintf("err: blood group is already on record and cannot be changed")}
+			}
+			currUser.BloodGroup = updateUser.BloodGroup
+		}
+		donorOnly := flags.Unavailable != nil || flags.Deferrals != nil || updateUser.LastDonation != "" || updateUser.DateOfBirth != "" || updateUser.WeightKg != 0
+		if donorOnly && currUser.Type != Donor{
+			return &httpError{http.StatusUnprocessableEntity, fmt.Sprintf("err: unavailable, last_donation, date_of_birth, weight_kg and deferrals are only kept for donors")}
+		}
+		if flags.Unavailable != nil{
+			currUser.Unavailable = *flags.Unavailable
+		}
+		if updateUser.LastDonation != ""{
+			currUser.LastDonation = updateUser.LastDonation
+			currUser.LastDonationKind = updateUser.LastDonationKind
+		}
+		if updateUser.WeightKg != 0{
+			currUser.WeightKg = updateUser.WeightKg
+		}
+		if flags.Deferrals != nil{
+			currUser.Deferrals = *flags.Deferrals
+		}
+		if flags.OfferedTypes != nil && currUser.Type != Donor || flags.NeededTypes != nil && currUser.Type != Patient{
+			return &httpError{http.StatusUnprocessableEntity, fmt.Sprintf("err: donors set offered_types, patients set needed_types")}
+		}
+		if flags.OfferedTypes != nil{
+			currUser.OfferedTypes = *flags.OfferedTypes
+		}
+		//retyping at a higher resolution replaces the whole typing
+		if updateUser.HLA != nil{
+			currUser.HLA = updateUser.HLA
+		}
+		if flags.NeededTypes != nil{
+			currUser.NeededTypes = *flags.NeededTypes
+		}
+		//like blood groups, a date of birth is only added, never changed
+		if updateUser.DateOfBirth != "" && updateUser.DateOfBirth != currUser.DateOfBirth{
+			if currUser.DateOfBirth != ""{
+				return &httpError{http.StatusUnprocessableEntity, fmt.Sprintf("err: date_of_birth is already on record and cannot be changed")}
+			}
+			currUser.DateOfBirth = updateUser.DateOfBirth
+		}
+		if(updateUser.Address != "" && updateUser.Address != currUser.Address){
 			currUser.Address = updateUser.Address
+			currUser.Location = updateUser.Location
+		} else if updateUser.Location != nil{
+			currUser.Location = updateUser.Location
 		}
 		if(updateUser.PhoneNo != ""){
 			currUser.PhoneNo = updateUser.PhoneNo
 		}
-		h.store.Donors[userConfig.Id] = currUser;
-		jsonBytes, err := json.Marshal(currUser)
-	
-		if err!=nil{
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte(err.Error()))
-			h.Unlock();
-			return
+		if err := validateDonationTypes(*currUser); err != nil{
+			return &httpError{http.StatusUnprocessableEntity, err.Error()}
 		}
-		w.Header().Add("content-type", "application/json")
-		w.Write((jsonBytes))
-		h.Unlock();
+		return nil
+	})
+	if err != nil{
+		writeStoreError(w, err, "UserId")
+		return
 	}
-	w.WriteHeader(http.StatusOK)
+
+	writeJSON(w, http.StatusOK, currUser)
 }
 
 //deleteUser
@@ -648,632 +997,300 @@ func (h *usersHandler) deleteUser(w http.ResponseWriter, r *http.Request,t strin
 	}
 
 	fmt.Println(userId);
-	
-	h.Lock();
-	userSecretCode, ok := h.store.IdsToSecretCodes[userId];
-	h.Unlock();
-	
-	if !ok{
-		w.WriteHeader(http.StatusNotFound)
-		w.Write([]byte(fmt.Sprintf("err: User Not Found. Check Input UserId")))
-		return
-	}
-	
-	h.Lock()
-	userConfig, ok := h.store.SecretCodesToIds[userSecretCode];
-	h.Unlock()
-	
-	if !ok{
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(fmt.Sprintf("err: UserId and Secret Code Mismatched. Contact Admin")))
-		return;
-	}
 
-	if userConfig.Type == Patient{
-		h.Lock()
-		delete(h.store.Patients, userConfig.Id);
-		delete(h.store.SecretCodesToIds, userSecretCode);
-		delete(h.store.IdsToSecretCodes, userConfig.Id);
-		h.store.Total -= 1;
-		h.store.TotalPatients -= 1;
-		h.Unlock();
-	}
-
-	if userConfig.Type == Donor{
-		h.Lock()
-		delete(h.store.Donors, userConfig.Id);
-		delete(h.store.SecretCodesToIds, userSecretCode);
-		delete(h.store.IdsToSecretCodes, userConfig.Id);
-		h.store.Total -= 1;
-		h.store.TotalDonors -= 1;
-		h.Unlock();
+	summary, err := h.store.DeleteUser(audited(r), userId)
+	if err != nil{
+		writeStoreError(w, err, "UserId")
+		return
 	}
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(fmt.Sprintf("user deleted. id: %d", userId)))
+	writeJSON(w, http.StatusOK, summary)
 }
 
 
 // sendRequest
 func (h *usersHandler) sendRequest(w http.ResponseWriter, r *http.Request,t string , p string){
 	fmt.Println("\n send Request started ");
-	
-	//user
-	userId, err := strconv.Atoi(t);
-	if err != nil{
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(fmt.Sprintf("err: invalid User id. Check Input UserId")))
-		return
-	}
-
-	fmt.Println(userId);
-	
-	h.Lock();
-	userSecretCode, ok := h.store.IdsToSecretCodes[userId];
-	h.Unlock();
-	
-	if !ok{
-		w.WriteHeader(http.StatusNotFound)
-		w.Write([]byte(fmt.Sprintf("err: User Not Found. Check Input UserId")))
-		return
-	}
-	
-	h.Lock()
-	userConfig, ok := h.store.SecretCodesToIds[userSecretCode];
-	h.Unlock()
 
-	if !ok{
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(fmt.Sprintf("err: Something is wrong! UserId and Secret Code Mismatched. Contact Admin")))
-		return;
+	//the body is optional and only carries a message for the recipient
+	var body struct{
+		Message string `json:"message"`
 	}
-
-	//request
-	requestId, err := strconv.Atoi(p);
-	if err != nil{
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(fmt.Sprintf("err: invalid Request id. Check request Id")))
+	if !readOptionalBody(w, r, &body){
 		return
 	}
-
-	fmt.Println(userId);
-	
-	h.Lock();
-	requestSecretCode, ok := h.store.IdsToSecretCodes[requestId];
-	h.Unlock();
-	
-	if !ok{
-		w.WriteHeader(http.StatusNotFound)
-		w.Write([]byte(fmt.Sprintf("err: User Not Found. Check Input RequestId")))
+	if len(body.Message) > maxRequestMessage{
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		w.Write([]byte(fmt.Sprintf("err: message is longer than %d bytes", maxRequestMessage)))
 		return
 	}
-	
-	h.Lock()
-	requestConfig, ok := h.store.SecretCodesToIds[requestSecretCode];
-	h.Unlock()
-
-	if !ok{
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(fmt.Sprintf("err: Something is wrong! RequestId and Secret Code Mismatched. Contact Admin")))
-		return;
-	}
 
-	if userConfig.Type == Patient{
-		h.Lock()
-		currUser := h.store.Patients[userConfig.Id];
-		isPresent := find(currUser.RequestedUserIds, requestId);
-		
-		if(isPresent!=-1){
-			w.WriteHeader(http.StatusOK)
-			h.Unlock()
-			return
-		}else{
-			currUser.RequestedUserIds = append(currUser.RequestedUserIds, requestConfig.Id);
+	warning := ""
+	var request Request
+	currUser, requestUser, ok := h.transition(w, r, EventSendRequest, t, p, func(tx *pairTx) error{
+		if pending, ok := tx.requests.pending(tx.user.Id, tx.counterpart.Id); ok{
+			request = pending
+			return errNoChange
 		}
-		
-		donorInfo, ok := h.store.Donors[requestConfig.Id];
-		if !ok {
-			w.WriteHeader(http.StatusNotFound)
-			w.Write([]byte(fmt.Sprintf("err: Check Input UserId DonorId : %d NOT FOUND", requestConfig.Id)))
-			h.Unlock();
-			return
+		if tx.connected(){
+			return &httpError{http.StatusBadRequest, fmt.Sprintf("err: INVALID. Already connected with %sId : %d", typeName(tx.counterpart.Type), tx.counterpart.Id)}
 		}
-		if find(donorInfo.PendingUserIds, userConfig.Id) == -1{
-			donorInfo.PendingUserIds = append(donorInfo.PendingUserIds, userConfig.Id)
+		//crossed requests would leave the pair pending after one is accepted
+		if _, ok := tx.requests.pending(tx.counterpart.Id, tx.user.Id); ok{
+			return &httpError{http.StatusBadRequest, fmt.Sprintf("err: INVALID. %sId : %d already sent you a request. Accept it instead", typeName(tx.counterpart.Type), tx.counterpart.Id)}
 		}
-		h.store.Donors[requestConfig.Id] = donorInfo;
-		h.store.Patients[userConfig.Id] = currUser;
-		h.Unlock();
-	}
 
-	if userConfig.Type == Donor{
-		h.Lock()
-		currUser := h.store.Donors[userConfig.Id];
-		isPresent := find(currUser.RequestedUserIds, requestId);
-		
-		if(isPresent!=-1){
-			w.WriteHeader(http.StatusOK)
-			h.Unlock()
-			return
-		}else{
-			currUser.RequestedUserIds = append(currUser.RequestedUserIds, requestConfig.Id);
-		}
-		
-		patientInfo, ok := h.store.Patients[requestConfig.Id];
-		if !ok {
-			w.WriteHeader(http.StatusNotFound)
-			w.Write([]byte(fmt.Sprintf("err: Check Input UserId PatientId : %d NOT FOUND", requestConfig.Id)))
-			h.Unlock();
-			return
+		var err error
+		if warning, err = h.checkRequest(tx.links, *tx.user, *tx.counterpart); err != nil{
+			return err
 		}
-		if find(patientInfo.PendingUserIds, userConfig.Id) == -1{
-			patientInfo.PendingUserIds = append(patientInfo.PendingUserIds, userConfig.Id)
-		}
-		
-		h.store.Patients[requestConfig.Id] = patientInfo;
-		h.store.Donors[userConfig.Id] = currUser;
-		h.Unlock();
+		request = h.addRequest(tx.requests, tx.user, tx.counterpart, body.Message)
+		return nil
+	})
+	if !ok{
+		return
 	}
+
 	println("Requests Succesful")
-	w.WriteHeader(http.StatusOK);
-	return
+	writeBloodCheck(w, currUser, requestUser, warning, &request, nil)
 }
 
 //acceptRequest
 func (h *usersHandler) acceptRequest(w http.ResponseWriter, r *http.Request,t string, p string ){
 	fmt.Println("\n accept Request started ");
-	//user
-	userId, err := strconv.Atoi(t);
-	if err != nil{
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(fmt.Sprintf("err: invalid User id. Check Input UserId")))
-		return
-	}
 
-	fmt.Println(userId);
-	
-	h.Lock();
-	userSecretCode, ok := h.store.IdsToSecretCodes[userId];
-	h.Unlock();
-	
-	if !ok{
-		w.WriteHeader(http.StatusNotFound)
-		w.Write([]byte(fmt.Sprintf("err: User Not Found. Check Input UserId")))
-		return
-	}
-	
-	h.Lock()
-	userConfig, ok := h.store.SecretCodesToIds[userSecretCode];
-	h.Unlock()
+	warning := ""
+	var request Request
+	currUser, requestUser, ok := h.transition(w, r, EventAcceptRequest, t, p, func(tx *pairTx) error{
+		currUser, requestUser := tx.user, tx.counterpart
+		other := typeName(requestUser.Type)
 
-	if !ok{
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(fmt.Sprintf("err: Something is wrong! UserId and Secret Code Mismatched. Contact Admin")))
-		return;
-	}
-
-	//request
-	requestId, err := strconv.Atoi(p);
-	if err != nil{
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(fmt.Sprintf("err: invalid Request id. Check request Id")))
-		return
-	}
-
-	fmt.Println(userId);
-	
-	h.Lock();
-	requestSecretCode, ok := h.store.IdsToSecretCodes[requestId];
-	h.Unlock();
-	
-	if !ok{
-		w.WriteHeader(http.StatusNotFound)
-		w.Write([]byte(fmt.Sprintf("err: User Not Found. Check Input RequestId")))
-		return
-	}
-	
-	h.Lock()
-	requestConfig, ok := h.store.SecretCodesToIds[requestSecretCode];
-	h.Unlock()
-
-	if !ok{
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(fmt.Sprintf("err: Something is wrong! RequestId and Secret Code Mismatched. Contact Admin")))
-		return;
-	}
-
-	if userConfig.Type == Patient{
-		h.Lock()
-		currUser := h.store.Patients[userConfig.Id];
-		if !ok {
-			w.WriteHeader(http.StatusNotFound)
-			w.Write([]byte(fmt.Sprintf("err: Check Input UserId. PatientId : %d NOT FOUND", requestConfig.Id)))
-			h.Unlock();
-			return
+		if requestUser.Deactivated{
+			return &httpError{http.StatusNotFound, fmt.Sprintf("err: Check Input UserId. %sId : %d NOT FOUND", typeName(otherType(currUser.Type)), requestUser.Id)}
 		}
 
-		donorInfo, ok := h.store.Donors[requestConfig.Id];
-		if !ok {
-			w.WriteHeader(http.StatusNotFound)
-			w.Write([]byte(fmt.Sprintf("err: Check Input UserId. DonorId : %d NOT FOUND", requestConfig.Id)))
-			h.Unlock();
-			return
-		}
-
-		isPresent := find(currUser.ConnectedUsersIds, requestId);
-		if(isPresent != -1){
-			println("Connections Succesful")
-			w.WriteHeader(http.StatusOK);
-			return;
-		}else{
-			currUser.ConnectedUsersIds = append(currUser.ConnectedUsersIds, requestConfig.Id);
-			donorInfo.ConnectedUsersIds = append(donorInfo.ConnectedUsersIds, userConfig.Id)
+		if tx.connected(){
+			return errNoChange
 		}
 
-		findRequestIndex := find(donorInfo.RequestedUserIds, userConfig.Id);
-		if findRequestIndex == -1{
-			w.WriteHeader(http.StatusBadRequest)
-			w.Write([]byte(fmt.Sprintf("err: Unauthorized Connection Attempt. No Donor Request Sent by donorId: %d", requestConfig.Id)))
-			h.Unlock();
-			return
-		}else{
-			donorInfo.RequestedUserIds = removeElementByIndex(donorInfo.RequestedUserIds, findRequestIndex);
+		if _, err := checkTypes(donorAndPatient(*currUser, *requestUser)); err != nil{
+			return err
 		}
-		h.store.Donors[requestConfig.Id] = donorInfo;
-		
-		findRequestIndex = find(currUser.PendingUserIds, requestConfig.Id);
-		if findRequestIndex == -1{
-			w.WriteHeader(http.StatusBadRequest)
-			w.Write([]byte(fmt.Sprintf("err: Unauthorized Connection Attempt. No Donor Request Received for donorId: %d", requestConfig.Id)))
-			h.Unlock();
-			return
-		}else{
-			currUser.PendingUserIds = removeElementByIndex(currUser.PendingUserIds, findRequestIndex);
+		var err error
+		if warning, err = h.checkBlood(*currUser, *requestUser); err != nil{
+			return err
 		}
-		
-		h.store.Patients[userConfig.Id] = currUser;
-		h.Unlock();
-	}
-
-	if userConfig.Type == Donor{
-		h.Lock()
-		currUser := h.store.Donors[userConfig.Id];
-		if !ok {
-			w.WriteHeader(http.StatusNotFound)
-			w.Write([]byte(fmt.Sprintf("err: Check Input UserId. PatientId : %d NOT FOUND", requestConfig.Id)))
-			h.Unlock();
-			return
+		if err := h.checkEligible(*currUser, *requestUser); err != nil{
+			return err
 		}
 
-		patientInfo, ok := h.store.Patients[requestConfig.Id];
-		if !ok {
-			w.WriteHeader(http.StatusNotFound)
-			w.Write([]byte(fmt.Sprintf("err: Check Input UserId. PartentId : %d NOT FOUND", requestConfig.Id)))
-			h.Unlock();
-			return
+		if !tx.requests.settle(requestUser.Id, currUser.Id, RequestAccepted){
+			return &httpError{http.StatusBadRequest, fmt.Sprintf("err: Unauthorized Connection Attempt. No %s Request Sent by %sId: %d", other, strings.ToLower(other), requestUser.Id)}
 		}
-		
-		isPresent := find(currUser.ConnectedUsersIds, requestId);
-		if(isPresent != -1){
-			println("Connections Succesful")
-			w.WriteHeader(http.StatusOK);
-			return;
-		}else{
-			currUser.ConnectedUsersIds = append(currUser.ConnectedUsersIds, requestConfig.Id);
-			patientInfo.ConnectedUsersIds = append(patientInfo.ConnectedUsersIds, userConfig.Id)
+		request, _ = tx.requests.get(requestUser.Id, currUser.Id, RequestAccepted)
+		//a request the other way, crossed before sending was refused for it,
+		//is answered by the connection too
+		tx.requests.settle(currUser.Id, requestUser.Id, RequestAccepted)
+
+		tx.connect()
+		if currUser.Type == Donor{
+			currUser.RequestsAnswered += 1
 		}
+		tx.fillBroadcasts()
+		return nil
+	})
+	if !ok{
+		return
+	}
 
-		findRequestIndex := find(patientInfo.RequestedUserIds, userConfig.Id);
-		if findRequestIndex == -1{
-			w.WriteHeader(http.StatusBadRequest)
-			w.Write([]byte(fmt.Sprintf("err: Unauthorized Connection Attempt. No Donor Request Sent by donorId: %d", requestConfig.Id)))
-			h.Unlock();
-			return
-		}else{
-			patientInfo.RequestedUserIds = removeElementByIndex(patientInfo.RequestedUserIds, findRequestIndex);
-		}
-		h.store.Patients[requestConfig.Id] = patientInfo;
-	
-		findRequestIndex = find(currUser.PendingUserIds, requestConfig.Id);
-		if findRequestIndex == -1{
-			w.WriteHeader(http.StatusBadRequest)
-			w.Write([]byte(fmt.Sprintf("err: Unauthorized Connection Attempt. No Donor Request Received Found for donorId: %d",requestConfig.Id)))
-			h.Unlock();
-			return
-		}else{
-			currUser.PendingUserIds = removeElementByIndex(currUser.PendingUserIds, findRequestIndex);
+	println("Connections Succesful")
+	donor, patient := donorAndPatient(currUser, requestUser)
+	var connection *Connection
+	for _, c := range h.store.Connections(donor.Id){
+		if c.PatientId == patient.Id{
+			found := c
+			connection = &found
 		}
-	
-		h.store.Donors[userConfig.Id] = currUser;
-		h.Unlock();
 	}
-	println("Connections Succesful")
-	w.WriteHeader(http.StatusOK);
-	return
+	writeBloodCheck(w, currUser, requestUser, warning, &request, connection)
 }
 
 //cancelRequest
 func (h *usersHandler) cancelRequest(w http.ResponseWriter, r *http.Request,t string, p string ){
 	fmt.Println("\n request cancel started ");
-	//user
-	userId, err := strconv.Atoi(t);
-	if err != nil{
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(fmt.Sprintf("err: invalid User id. Check Input UserId")))
-		return
-	}
 
-	fmt.Println(userId);
-	
-	h.Lock();
-	userSecretCode, ok := h.store.IdsToSecretCodes[userId];
-	h.Unlock();
-	
+	_, _, ok := h.transition(w, r, EventCancelRequest, t, p, func(tx *pairTx) error{
+		if !dropRequest(tx.requests, tx.user, tx.counterpart){
+			return &httpError{http.StatusBadRequest, fmt.Sprintf("err: INVALID. No Send Request Found to %sId : %d", typeName(tx.counterpart.Type), tx.counterpart.Id)}
+		}
+		return nil
+	})
 	if !ok{
-		w.WriteHeader(http.StatusNotFound)
-		w.Write([]byte(fmt.Sprintf("err: User Not Found. Check Input UserId")))
 		return
 	}
-	
-	h.Lock()
-	userConfig, ok := h.store.SecretCodesToIds[userSecretCode];
-	h.Unlock()
 
-	if !ok{
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(fmt.Sprintf("err: Something is wrong! UserId and Secret Code Mismatched. Contact Admin")))
-		return;
-	}
+	println("Request Cancelled")
+	w.WriteHeader(http.StatusOK);
+}
 
-	//request
-	requestId, err := strconv.Atoi(p);
-	if err != nil{
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(fmt.Sprintf("err: invalid Request id. Check request Id")))
-		return
+//declineRequest turns down a request received from the other user, who is
+//notified. with block set, that user can not send requests again
+func (h *usersHandler) declineRequest(w http.ResponseWriter, r *http.Request,t string, p string ){
+	//the body is optional
+	var body struct{
+		Reason string `json:"reason"`
+		Block  bool   `json:"block"`
 	}
-
-	fmt.Println(userId);
-	
-	h.Lock();
-	requestSecretCode, ok := h.store.IdsToSecretCodes[requestId];
-	h.Unlock();
-	
-	if !ok{
-		w.WriteHeader(http.StatusNotFound)
-		w.Write([]byte(fmt.Sprintf("err: User Not Found. Check Input RequestId")))
+	if !readOptionalBody(w, r, &body){
 		return
 	}
-	
-	h.Lock()
-	requestConfig, ok := h.store.SecretCodesToIds[requestSecretCode];
-	h.Unlock()
-
-	if !ok{
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(fmt.Sprintf("err: Something is wrong! RequestId and Secret Code Mismatched. Contact Admin")))
-		return;
+	if len(body.Reason) > maxRequestMessage{
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		w.Write([]byte(fmt.Sprintf("err: reason is longer than %d bytes", maxRequestMessage)))
+		return
 	}
 
-	if(userConfig.Type == Patient){
-		h.Lock()
-		currUser := h.store.Patients[userConfig.Id];
-		if !ok {
-			w.WriteHeader(http.StatusNotFound)
-			w.Write([]byte(fmt.Sprintf("err: Check Input UserId. PatientId : %d NOT FOUND", requestConfig.Id)))
-			h.Unlock();
-			return
+	var request Request
+	_, _, ok := h.transition(w, r, EventDeclineRequest, t, p, func(tx *pairTx) error{
+		var ok bool
+		if request, ok = tx.requests.decline(tx.counterpart.Id, tx.user.Id, body.Reason); !ok{
+			return &httpError{http.StatusBadRequest, fmt.Sprintf("err: INVALID. No Request Received from %sId : %d", typeName(tx.counterpart.Type), tx.counterpart.Id)}
 		}
-
-		donorInfo, ok := h.store.Donors[requestConfig.Id];
-		if !ok {
-			w.WriteHeader(http.StatusNotFound)
-			w.Write([]byte(fmt.Sprintf("err: Check Input UserId. DonorId : %d NOT FOUND", requestConfig.Id)))
-			h.Unlock();
-			return
+		if body.Block{
+			tx.block()
 		}
+		return nil
+	})
+	if !ok{
+		return
+	}
 
-		isPresent := find(currUser.RequestedUserIds, requestConfig.Id);
-		if(isPresent == -1){
-			w.WriteHeader(http.StatusBadRequest)
-			w.Write([]byte(fmt.Sprintf("err: INVALID. No Send Request Found to DonorId : %d", requestConfig.Id)))
-			h.Unlock();
-			return
-		}else{
-			currUser.RequestedUserIds = removeElementByIndex(currUser.RequestedUserIds, isPresent);
-		}
-		h.store.Patients[userConfig.Id] = currUser;
-		
-		isPresent = find(donorInfo.PendingUserIds, userConfig.Id);
-		donorInfo.PendingUserIds = removeElementByIndex(donorInfo.PendingUserIds, isPresent);
-		
-		h.store.Donors[requestConfig.Id] = donorInfo;
-		h.Unlock();
-	}
-	if(userConfig.Type == Donor){
-		h.Lock()
-		currUser := h.store.Donors[userConfig.Id];
-		if !ok {
-			w.WriteHeader(http.StatusNotFound)
-			w.Write([]byte(fmt.Sprintf("err: Check Input UserId. UserId : %d NOT FOUND", requestConfig.Id)))
-			h.Unlock();
-			return
-		}
+	writeJSON(w, http.StatusOK, request)
+}
 
-		patientInfo, ok := h.store.Patients[requestConfig.Id];
-		if !ok {
-			w.WriteHeader(http.StatusNotFound)
-			w.Write([]byte(fmt.Sprintf("err: Check Input UserId. PatientId : %d NOT FOUND", requestConfig.Id)))
-			h.Unlock();
-			return
+//unblockUser lets the other user send requests again after a decline blocked it
+func (h *usersHandler) unblockUser(w http.ResponseWriter, r *http.Request,t string, p string ){
+	currUser, _, ok := h.transition(w, r, EventUnblockUser, t, p, func(tx *pairTx) error{
+		if !tx.unblock(){
+			return errNoChange
 		}
+		return nil
+	})
+	if !ok{
+		return
+	}
 
-		isPresent := find(currUser.RequestedUserIds, requestConfig.Id);
-		if(isPresent == -1){
-			w.WriteHeader(http.StatusBadRequest)
-			w.Write([]byte(fmt.Sprintf("err: INVALID. No Send Request Found to PatientId : %d", requestConfig.Id)))
-			h.Unlock();
-			return
-		}else{
-			currUser.RequestedUserIds = removeElementByIndex(currUser.RequestedUserIds, isPresent);
-		}
-		h.store.Donors[userConfig.Id] = currUser;
-		
-		isPresent = find(patientInfo.PendingUserIds, userConfig.Id);
-		patientInfo.PendingUserIds = removeElementByIndex(patientInfo.PendingUserIds, isPresent);
-		
-		h.store.Patients[requestConfig.Id] = patientInfo;
-		h.Unlock();
+	user, err := h.store.GetUser(currUser.Id)
+	if err != nil{
+		writeStoreError(w, err, "UserId")
+		return
 	}
-	println("Request Cancelled")
-	w.WriteHeader(http.StatusOK);
-	return
+	writeJSON(w, http.StatusOK, user)
 }
 
 //cancelConnection
 func (h *usersHandler) cancelConnection(w http.ResponseWriter, r *http.Request,t string, p string ){
 	fmt.Println("\n connection cancel started ");
-	//user
-	userId, err := strconv.Atoi(t);
-	if err != nil{
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(fmt.Sprintf("err: invalid User id. Check Input UserId")))
-		return
-	}
 
-	fmt.Println(userId);
-	
-	h.Lock();
-	userSecretCode, ok := h.store.IdsToSecretCodes[userId];
-	h.Unlock();
-	
+	_, _, ok := h.transition(w, r, EventCancelConnection, t, p, func(tx *pairTx) error{
+		if !tx.disconnect(){
+			return &httpError{http.StatusBadRequest, fmt.Sprintf("err: INVALID. No Connection Found b/w %sId : %d and UserID: %d", typeName(tx.counterpart.Type), tx.counterpart.Id, tx.user.Id)}
+		}
+		return nil
+	})
 	if !ok{
-		w.WriteHeader(http.StatusNotFound)
-		w.Write([]byte(fmt.Sprintf("err: User Not Found. Check Input UserId")))
 		return
 	}
-	
-	h.Lock()
-	userConfig, ok := h.store.SecretCodesToIds[userSecretCode];
-	h.Unlock()
 
-	if !ok{
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(fmt.Sprintf("err: Something is wrong! UserId and Secret Code Mismatched. Contact Admin")))
-		return;
-	}
+	println("Connection Cancelled")
+	w.WriteHeader(http.StatusOK);
+}
 
-	//request
-	requestId, err := strconv.Atoi(p);
+//func init
+func main(){
+	//subcommands come before the flags of the server
+	if len(os.Args) > 1 && os.Args[1] == "fsck"{
+		os.Exit(runFsck(os.Args[2:]))
+	}
+
+	dataFile := flag.String("data", "hospital.json", "path of the hospital snapshot file, empty keeps the store in memory only")
+	compactEvery := flag.Int("compact-every", 100, "fold the journal into a new snapshot after this many events, 0 never compacts")
+	sessionKey := flag.String("session-key", "session.key", "path of the key session tokens are signed with, created if missing")
+	sessionTTL := flag.Duration("session-ttl", 12*time.Hour, "how long a session token issued by login stays valid")
+	bloodCheck := flag.String("blood-check", bloodCheckReject, "what to do when a donor's red cells are incompatible with a patient: reject, warn or off")
+	geocodeTable := flag.String("geocode-table", "", "json file of {address: {lat, lng}} addresses are geocoded from, empty leaves locations to the users")
+	eligibilityRules := flag.String("eligibility-rules", "", "json file overriding the donor eligibility rules: min_age_years, max_age_years, min_weight_kg, interval_days")
+	requestTTL := flag.Duration("request-ttl", 14*24*time.Hour, "how long a request stays pending before it expires, 0 never expires requests")
+	bootstrapAdmin := flag.String("bootstrap-admin", "admin", "name of the admin created, with its secret code printed, when there is no staff yet")
+	flag.Parse()
+
+	key, err := loadSessionKey(*sessionKey)
 	if err != nil{
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(fmt.Sprintf("err: invalid Request id. Check request Id")))
-		return
+		panic(err)
 	}
 
-	fmt.Println(userId);
-	
-	h.Lock();
-	requestSecretCode, ok := h.store.IdsToSecretCodes[requestId];
-	h.Unlock();
-	
-	if !ok{
-		w.WriteHeader(http.StatusNotFound)
-		w.Write([]byte(fmt.Sprintf("err: User Not Found. Check Input RequestId")))
-		return
+	var store Store
+	mem := newMemStore(emptyHospital())
+	journaled := []AuditEntry{}
+	store = mem
+	if *dataFile != ""{
+		fs, err := openFileStore(*dataFile, *compactEvery, false)
+		if err != nil{
+			panic(err)
+		}
+		store, mem, journaled = fs, fs.memStore, fs.journaled
 	}
-	
-	h.Lock()
-	requestConfig, ok := h.store.SecretCodesToIds[requestSecretCode];
-	h.Unlock()
 
-	if !ok{
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(fmt.Sprintf("err: Something is wrong! RequestId and Secret Code Mismatched. Contact Admin")))
-		return;
+	auditFile := ""
+	if *dataFile != ""{
+		auditFile = auditPath(*dataFile)
+	}
+	auditLog, err := openAuditLog(auditFile, auditKey(key))
+	if err != nil{
+		panic(err)
+	}
+	//entries journaled but not written before a crash are written now
+	if err := mem.attachAudit(auditLog, journaled); err != nil{
+		fmt.Printf("warning: audit trail %s could not catch up with the journal: %v\n", auditFile, err)
+	}
+	if seq := auditLog.verify(); seq != 0{
+		fmt.Printf("warning: audit trail %s does not verify from entry %d on, it may have been tampered with\n", auditFile, seq)
 	}
 
-	if(userConfig.Type == Patient){
-		h.Lock()
-		currUser := h.store.Patients[userConfig.Id];
-		if !ok {
-			w.WriteHeader(http.StatusNotFound)
-			w.Write([]byte(fmt.Sprintf("err: Check Input UserId. PatientId : %d NOT FOUND", requestConfig.Id)))
-			h.Unlock();
-			return
-		}
-
-		donorInfo, ok := h.store.Donors[requestConfig.Id];
-		if !ok {
-			w.WriteHeader(http.StatusNotFound)
-			w.Write([]byte(fmt.Sprintf("err: Check Input UserId. DonorId : %d NOT FOUND", requestConfig.Id)))
-			h.Unlock();
-			return
-		}
-
-		isPresent := find(currUser.ConnectedUsersIds, requestConfig.Id);
-		if(isPresent == -1){
-			w.WriteHeader(http.StatusBadRequest)
-			w.Write([]byte(fmt.Sprintf("err: INVALID. No Connection Found b/w DonorId : %d and UserID: %d", requestConfig.Id, userConfig.Id)))
-			h.Unlock();
-			return
-		}else{
-			currUser.ConnectedUsersIds = removeElementByIndex(currUser.ConnectedUsersIds, isPresent);
+	usersHandler := newUsersHandler(store, newSessions(key, *sessionTTL), auditLog);
+	if *geocodeTable != ""{
+		table, err := loadTableGeocoder(*geocodeTable)
+		if err != nil{
+			panic(err)
 		}
-		h.store.Patients[userConfig.Id] = currUser;
-		
-		isPresent = find(donorInfo.ConnectedUsersIds, userConfig.Id);
-		donorInfo.ConnectedUsersIds = removeElementByIndex(donorInfo.ConnectedUsersIds, isPresent);
-		h.store.Donors[requestConfig.Id] = donorInfo;
-		h.Unlock();
-	}
-	if(userConfig.Type == Donor){
-		h.Lock()
-		currUser := h.store.Donors[userConfig.Id];
-		if !ok {
-			w.WriteHeader(http.StatusNotFound)
-			w.Write([]byte(fmt.Sprintf("err: Check Input UserId. UserId : %d NOT FOUND", requestConfig.Id)))
-			h.Unlock();
-			return
-		}
-
-		patientInfo, ok := h.store.Patients[requestConfig.Id];
-		if !ok {
-			w.WriteHeader(http.StatusNotFound)
-			w.Write([]byte(fmt.Sprintf("err: Check Input UserId. PatientId : %d NOT FOUND", requestConfig.Id)))
-			h.Unlock();
-			return
-		}
-
-		isPresent := find(currUser.ConnectedUsersIds, requestConfig.Id);
-		if(isPresent == -1){
-			w.WriteHeader(http.StatusBadRequest)
-			w.Write([]byte(fmt.Sprintf("err: INVALID. No Send Request Found to PatientId : %d", requestConfig.Id)))
-			h.Unlock();
-			return
-		}else{
-			currUser.ConnectedUsersIds = removeElementByIndex(currUser.ConnectedUsersIds, isPresent);
+		usersHandler.geocoder = table
+	}
+	if *eligibilityRules != ""{
+		rules, err := loadEligibilityRules(*eligibilityRules)
+		if err != nil{
+			panic(err)
 		}
-		h.store.Donors[userConfig.Id] = currUser;
-		
-		isPresent = find(patientInfo.ConnectedUsersIds, userConfig.Id);
-		patientInfo.ConnectedUsersIds = removeElementByIndex(patientInfo.ConnectedUsersIds, isPresent);
-
-		h.store.Patients[requestConfig.Id] = patientInfo;
-		h.Unlock();
+		usersHandler.rules = rules
 	}
-	println("Connection Cancelled")
-	w.WriteHeader(http.StatusOK);
-	return
-}
-
-//func init
-func main(){
-	usersHandler := newUsersHandler();
-	http.HandleFunc("/users/", usersHandler.users);
-	http.HandleFunc("/user/",usersHandler.user);
+	switch *bloodCheck{
+	case bloodCheckReject, bloodCheckWarn, bloodCheckOff:
+		usersHandler.bloodCheck = *bloodCheck
+	default:
+		panic(fmt.Sprintf("-blood-check must be reject, warn or off, got %q", *bloodCheck))
+	}
+	if *requestTTL < 0{
+		panic(fmt.Sprintf("-request-ttl must not be negative, got %s", *requestTTL))
+	}
+	usersHandler.requestTTL = *requestTTL
+	if *requestTTL > 0{
+		go usersHandler.expireRequests(sweepInterval(*requestTTL))
+	}
+	if err := usersHandler.bootstrapAdmin(*bootstrapAdmin); err != nil{
+		panic(err)
+	}
+	usersHandler.routes(http.DefaultServeMux)
 
-	err := http.ListenAndServe(":8080", nil);
+	err = http.ListenAndServe(":8080", nil);
 	if err != nil{
 		panic(err)
 	}
-}
\ No newline at end of file
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+//testServer serves the routes of a usersHandler over an in-memory store
+type testServer struct {
+	t     *testing.T
+	h     *usersHandler
+	store *memStore
+	mux   *http.ServeMux
+	codes map[int]string //secret codes of the users signed up
+}
+
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+	store := newMemStore(emptyHospital())
+	key := []byte("test session key, not a secret")
+	audit, err := openAuditLog("", auditKey(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.attachAudit(audit, nil); err != nil {
+		t.Fatal(err)
+	}
+	h := newUsersHandler(store, newSessions(key, time.Hour), audit)
+	mux := http.NewServeMux()
+	h.routes(mux)
+	return &testServer{t: t, h: h, store: store, mux: mux, codes: map[int]string{}}
+}
+
+//do sends method path with body as token, and returns the answer
+func (s *testServer) do(method string, path string, token string, body string) *httptest.ResponseRecorder {
+	s.t.Helper()
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	r.Header.Set("content-type", "application/json")
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	s.mux.ServeHTTP(w, r)
+	return w
+}
+
+//login logs in with code at path, users or admin, and returns the token
+func (s *testServer) login(path string, code string) string {
+	s.t.Helper()
+	w := s.do("POST", path+"/login", "", fmt.Sprintf(`{"secret_code":%q}`, code))
+	var data struct {
+		Token string `json:"token"`
+	}
+	if w.Code != http.StatusOK || json.Unmarshal(w.Body.Bytes(), &data) != nil {
+		s.t.Fatalf("login at %s: %d %s", path, w.Code, w.Body)
+	}
+	return data.Token
+}
+
+//signup signs up the user in body and returns it with a session token
+func (s *testServer) signup(body string) (User, string) {
+	s.t.Helper()
+	w := s.do("POST", "/users/signup", "", body)
+	var data struct {
+		User User   `json:"user_data"`
+		Code string `json:"user_secret_code"`
+	}
+	if w.Code != http.StatusOK || json.Unmarshal(w.Body.Bytes(), &data) != nil {
+		s.t.Fatalf("signup: %d %s", w.Code, w.Body)
+	}
+	s.codes[data.User.Id] = data.Code
+	return data.User, s.login("/users", data.Code)
+}
+
+//admin creates an admin and returns its session token
+func (s *testServer) admin() string {
+	s.t.Helper()
+	code, _, err := s.h.addStaff(nil, StaffMember{Name: "admin", Role: Admin})
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	return s.login("/admin", code)
+}
+
+const (
+	testPatient = `{"name":"p","address":"a","phone_no":"1","type":0,"blood_group":"A+"}`
+	testDonor   = `{"name":"d","address":"a","phone_no":"2","type":1,"blood_group":"O-","date_of_birth":"1990-01-01","weight_kg":70}`
+)
+
+func TestUserRoutesNeedOwnSession(t *testing.T) {
+	s := newTestServer(t)
+	patient, patientToken := s.signup(testPatient)
+	donor, donorToken := s.signup(testDonor)
+
+	tests := []struct {
+		method string
+		path   string
+		token  string
+		want   int
+	}{
+		{"GET", fmt.Sprintf("/user/%d", patient.Id), "", http.StatusUnauthorized},
+		{"GET", fmt.Sprintf("/user/%d", patient.Id), "not a token", http.StatusUnauthorized},
+		{"GET", fmt.Sprintf("/user/%d", patient.Id), donorToken, http.StatusForbidden},
+		{"GET", fmt.Sprintf("/user/%d", patient.Id), patientToken, http.StatusOK},
+		{"SEND", fmt.Sprintf("/user/%d/request/%d", patient.Id, donor.Id), donorToken, http.StatusForbidden},
+		{"GET", "/users/patients", "", http.StatusUnauthorized},
+		{"GET", "/users/patients", donorToken, http.StatusOK},
+		{"GET", "/users/donors", "", http.StatusOK},
+		{"GET", "/admin/users", donorToken, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		if w := s.do(tt.method, tt.path, tt.token, ""); w.Code != tt.want {
+			t.Errorf("%s %s: %d %s, want %d", tt.method, tt.path, w.Code, w.Body, tt.want)
+		}
+	}
+}
+
+func TestSignupIgnoresServerFields(t *testing.T) {
+	s := newTestServer(t)
+	other, _ := s.signup(testDonor)
+	body := `{"name":"p","address":"a","phone_no":"1","type":0,"blood_group":"A+",
+		"id":99,"deactivated":true,"connected_users_ids":[` + fmt.Sprint(other.Id) + `],
+		"pending_user_ids":[` + fmt.Sprint(other.Id) + `],"urgency":"critical"}`
+	user, _ := s.signup(body)
+
+	stored, err := s.store.GetUser(user.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Id == 99 || stored.Deactivated || len(stored.ConnectedUsersIds) != 0 || len(stored.PendingUserIds) != 0 {
+		t.Errorf("signup kept fields the server sets: %+v", stored)
+	}
+	if s.store.hospital.Graph.has(EdgeConnected, user.Id, other.Id) {
+		t.Errorf("signup connected %d to %d", user.Id, other.Id)
+	}
+}
+
+func TestRequestAcceptConnectsPair(t *testing.T) {
+	s := newTestServer(t)
+	patient, patientToken := s.signup(testPatient)
+	donor, donorToken := s.signup(testDonor)
+	request := fmt.Sprintf("/user/%d/request/%d", patient.Id, donor.Id)
+	accept := fmt.Sprintf("/user/%d/request/%d", donor.Id, patient.Id)
+
+	steps := []struct {
+		method string
+		path   string
+		token  string
+		want   int
+	}{
+		{"ACCEPT", accept, donorToken, http.StatusBadRequest}, //nothing sent yet
+		{"SEND", request, patientToken, http.StatusOK},
+		{"SEND", request, patientToken, http.StatusOK}, //a resend is answered like the first
+		{"ACCEPT", accept, donorToken, http.StatusOK},
+		{"ACCEPT", accept, donorToken, http.StatusOK}, //already connected, nothing changes
+	}
+	for i, step := range steps {
+		if w := s.do(step.method, step.path, step.token, ""); w.Code != step.want {
+			t.Fatalf("step %d, %s %s: %d %s, want %d", i, step.method, step.path, w.Code, w.Body, step.want)
+		}
+	}
+
+	for _, id := range []int{patient.Id, donor.Id} {
+		user, err := s.store.GetUser(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(user.ConnectedUsersIds) != 1 || len(user.PendingUserIds) != 0 || len(user.RequestedUserIds) != 0 {
+			t.Errorf("user %d after accept: connected %v, pending %v, requested %v", id, user.ConnectedUsersIds, user.PendingUserIds, user.RequestedUserIds)
+		}
+	}
+}
+
+func TestDeactivateIsAuditedOnce(t *testing.T) {
+	s := newTestServer(t)
+	adminToken := s.admin()
+	patient, _ := s.signup(testPatient)
+	path := fmt.Sprintf("/admin/users/%d/deactivate", patient.Id)
+
+	before := len(s.h.auditLog.entries)
+	for i := 0; i < 2; i++ {
+		if w := s.do("POST", path, adminToken, ""); w.Code != http.StatusOK {
+			t.Fatalf("deactivate %d: %d %s", i, w.Code, w.Body)
+		}
+	}
+	if got := len(s.h.auditLog.entries) - before; got != 1 {
+		t.Errorf("%d audit entries for deactivating twice, want 1", got)
+	}
+	if seq := s.h.auditLog.verify(); seq != 0 {
+		t.Errorf("audit trail breaks at entry %d", seq)
+	}
+	if s.store.hospital.AuditSeq != len(s.h.auditLog.entries) {
+		t.Errorf("store records audit entry %d, trail has %d", s.store.hospital.AuditSeq, len(s.h.auditLog.entries))
+	}
+
+	w := s.do("POST", "/users/login", "", fmt.Sprintf(`{"secret_code":%q}`, s.codes[patient.Id]))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("login while deactivated: %d %s, want %d", w.Code, w.Body, http.StatusForbidden)
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrNoSession      = errors.New("no session token")
+	ErrBadSession     = errors.New("invalid session token")
+	ErrExpiredSession = errors.New("session expired")
+	ErrRevokedSession = errors.New("session revoked")
+)
+
+//sessionClaims is the signed payload of a session token
+type sessionClaims struct {
+	UserId   int      `json:"uid"`
+	Type     UserType `json:"typ"`
+	Version  int      `json:"ver"` //SessionVersion of the credential at login
+	IssuedAt int64    `json:"iat"`
+	Expires  int64    `json:"exp"`
+}
+
+//sessions issues and checks session tokens of the form
+//base64url(claims json) "." base64url(hmac-sha256 of the first part)
+type sessions struct {
+	key []byte
+	ttl time.Duration
+}
+
+func newSessions(key []byte, ttl time.Duration) *sessions {
+	return &sessions{
+		key: key,
+		ttl: ttl,
+	}
+}
+
+//loadSessionKey reads the signing key at path, creating a random one if the
+//file does not exist yet so tokens stay valid across restarts
+func loadSessionKey(path string) ([]byte, error) {
+	key, err := ioutil.ReadFile(path)
+	if err == nil {
+		if len(key) < 32 {
+			return nil, fmt.Errorf("session key %s is shorter than 32 bytes", path)
+		}
+		return key, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	key = make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(path, key, 0600); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func (s *sessions) sign(payload string) string {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+//issue returns a token for the user or staff member logged in with cred, and when it expires
+func (s *sessions) issue(cred UserProtected) (string, time.Time, error) {
+	now := time.Now()
+	expires := now.Add(s.ttl)
+	claims := sessionClaims{
+		UserId:   cred.Id,
+		Type:     cred.Type,
+		Version:  cred.SessionVersion,
+		IssuedAt: now.Unix(),
+		Expires:  expires.Unix(),
+	}
+	data, err := json.Marshal(claims)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	return payload + "." + s.sign(payload), expires, nil
+}
+
+//verify checks the signature and expiry of token and returns its claims
+func (s *sessions) verify(token string) (sessionClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return sessionClaims{}, ErrBadSession
+	}
+	if !hmac.Equal([]byte(parts[1]), []byte(s.sign(parts[0]))) {
+		return sessionClaims{}, ErrBadSession
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return sessionClaims{}, ErrBadSession
+	}
+	var claims sessionClaims
+	if err := json.Unmarshal(data, &claims); err != nil {
+		return sessionClaims{}, ErrBadSession
+	}
+	if time.Now().Unix() >= claims.Expires {
+		return sessionClaims{}, ErrExpiredSession
+	}
+	return claims, nil
+}
+
+//fromRequest verifies the token of an Authorization: Bearer header
+func (s *sessions) fromRequest(r *http.Request) (sessionClaims, error) {
+	header := r.Header.Get("Authorization")
+	if header == "" {
+		return sessionClaims{}, ErrNoSession
+	}
+	const prefix = "Bearer "
+	if len(header) <= len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) {
+		return sessionClaims{}, ErrBadSession
+	}
+	return s.verify(strings.TrimSpace(header[len(prefix):]))
+}
+
+type callerKey struct{}
+
+//authenticate resolves the caller of r from its bearer token. tokens issued
+//before the caller's secret code was rotated or revoked, or whose user or
+//staff member was deleted or deactivated since, are rejected
+func (h *usersHandler) authenticate(r *http.Request) (sessionClaims, error) {
+	claims, err := h.sessions.fromRequest(r)
+	if err != nil {
+		return claims, err
+	}
+
+	cred, err := h.store.Credential(claims.UserId)
+	if err != nil || cred.Revoked || cred.SessionVersion != claims.Version || cred.Type != claims.Type {
+		return claims, ErrRevokedSession
+	}
+	switch claims.Type {
+	case Patient, Donor:
+		user, err := h.store.GetUser(claims.UserId)
+		if err != nil || user.Deactivated {
+			return claims, ErrRevokedSession
+		}
+	default:
+		if member, err := h.store.GetStaff(claims.UserId); err != nil || member.Deactivated {
+			return claims, ErrRevokedSession
+		}
+	}
+	return claims, nil
+}
+
+//writeUnauthorized answers a request authenticate rejected with err
+func writeUnauthorized(w http.ResponseWriter, err error) {
+	w.Header().Set("WWW-Authenticate", `Bearer realm="donor_patient_app"`)
+	w.WriteHeader(http.StatusUnauthorized)
+	w.Write([]byte(fmt.Sprintf("err: %s. Login again", err.Error())))
+}
+
+//requireSession resolves the caller from the bearer token before calling next.
+//requests without a valid token are answered with 401
+func (h *usersHandler) requireSession(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		claims, err := h.authenticate(r)
+		if err != nil {
+			writeUnauthorized(w, err)
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), callerKey{}, claims)))
+	}
+}
+
+//callerOf returns the claims requireSession stored on r
+func callerOf(r *http.Request) (sessionClaims, bool) {
+	claims, ok := r.Context().Value(callerKey{}).(sessionClaims)
+	return claims, ok
+}
+
+//ownsUser reports whether the caller of r may act as the user with id t.
+//if not, 403 is written to w
+func ownsUser(w http.ResponseWriter, r *http.Request, t string) bool {
+	id, err := strconv.Atoi(t)
+	if err != nil {
+		//not an id at all, the handler answers that with 400
+		return true
+	}
+	claims, ok := callerOf(r)
+	if !ok || claims.UserId != id {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(fmt.Sprintf("err: you may only act on your own user id")))
+		return false
+	}
+	return true
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+//loadHospital reads the snapshot at path into a Hospital.
+//a missing file is not an error, the server simply starts with an empty store
+func loadHospital(path string) (Hospital, error) {
+	hospital := emptyHospital()
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return hospital, nil
+	}
+	if err != nil {
+		return hospital, err
+	}
+
+	err = json.Unmarshal(data, &hospital)
+	return hospital, err
+}
+
+//saveHospital writes a snapshot of hospital to path.
+//the snapshot goes to a temp file in the same directory which is synced and
+//then renamed over path, so a crash leaves either the old or the new snapshot
+func saveHospital(path string, hospital Hospital) error {
+	data, err := json.Marshal(hospital)
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(path)
+	tmp, err := ioutil.TempFile(dir, filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmpName)
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmpName)
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	if err := os.Rename(tmpName, path); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+
+	//sync the directory so the rename itself survives a crash
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+//fileStore is a memStore whose events are journaled next to a snapshot file.
+//every compactEvery events the journal is folded into a new snapshot
+type fileStore struct {
+	*memStore
+	dataFile string
+	journal  *journal
+	lock     *os.File //held as long as the process runs
+	//journaled are the audit entries of the events in the journal at open
+	journaled []AuditEntry
+}
+
+//lockPath is where the lock of the store at dataFile is taken
+func lockPath(dataFile string) string {
+	return dataFile + ".lock"
+}
+
+//lockStore takes the exclusive lock of the store at dataFile, so a server
+//and an offline fsck never open the same store at once
+func lockStore(dataFile string) (*os.File, error) {
+	file, err := os.OpenFile(lockPath(dataFile), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		file.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, fmt.Errorf("store %s is in use by another process", dataFile)
+		}
+		return nil, err
+	}
+	return file, nil
+}
+
+var errReadOnly = errors.New("store is open read-only")
+
+//openFileStore loads the snapshot at dataFile and replays the events journaled
+//since. a read-only store leaves the files as they are: a torn last event is
+//skipped instead of cut off, and every change is refused
+func openFileStore(dataFile string, compactEvery int, readOnly bool) (*fileStore, error) {
+	lock, err := lockStore(dataFile)
+	if err != nil {
+		return nil, err
+	}
+
+	hospital, err := loadHospital(dataFile)
+	if err != nil {
+		lock.Close()
+		return nil, err
+	}
+
+	replayed, audited, err := replayJournal(journalPath(dataFile), &hospital, !readOnly)
+	if err != nil {
+		lock.Close()
+		return nil, err
+	}
+	fmt.Fprintf(os.Stderr, "store loaded. seq: %d, replayed events: %d\n", hospital.Seq, replayed)
+
+	fs := &fileStore{
+		dataFile:  dataFile,
+		lock:      lock,
+		journaled: audited,
+	}
+	if readOnly {
+		fs.memStore = newMemStore(hospital)
+		fs.record = func(ev Event) error { return errReadOnly }
+		return fs, nil
+	}
+
+	j, err := openJournal(journalPath(dataFile), compactEvery)
+	if err != nil {
+		lock.Close()
+		return nil, err
+	}
+	j.pending = replayed
+
+	fs.memStore = newMemStore(hospital)
+	fs.journal = j
+	fs.record = fs.append
+	return fs, nil
+}
+
+//append journals ev. it runs under the memStore lock before ev is applied, so
+//a due compaction snapshots exactly the events already in the journal
+func (fs *fileStore) append(ev Event) error {
+	if fs.journal.needsCompaction() {
+		//a failed compaction is retried on the next event
+		if err := fs.journal.compact(fs.dataFile, fs.hospital); err != nil {
+			fmt.Fprintln(os.Stderr, "journal compaction failed:", err)
+		}
+	}
+	return fs.journal.append(ev)
+}
+
+//Close closes the journal and releases the lock of the store
+func (fs *fileStore) Close() error {
+	var err error
+	if fs.journal != nil {
+		err = fs.journal.file.Close()
+	}
+	if e := fs.lock.Close(); err == nil {
+		err = e
+	}
+	return err
+}
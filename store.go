@@ -0,0 +1,644 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	ErrUserNotFound  = errors.New("user not found")
+	ErrCodeMismatch  = errors.New("user id and secret code mismatched")
+	ErrUnknownSecret = errors.New("secret code not found")
+	ErrSelectorTaken = errors.New("secret code selector already in use")
+	ErrUserConflict  = errors.New("user id is both a patient and a donor")
+
+	ErrBroadcastNotFound = errors.New("broadcast not found")
+)
+
+//errNoChange is returned from an update func when the store is already in the
+//requested state. the update is then dropped without error
+var errNoChange = errors.New("no change")
+
+//Store is what the handlers persist users through. every mutation is named by
+//the EventType it is recorded as, and takes the audit entry recorded with it,
+//by, naming who made it. a nil by leaves the mutation out of the audit trail
+type Store interface {
+	//GetUser returns the user with id
+	GetUser(id int) (User, error)
+	//ListUsers returns every user of type t, in no particular order
+	ListUsers(t UserType) []User
+	//DonorsNear returns the donors within radiusKm of center, nearest first
+	DonorsNear(center Location, radiusKm float64) []geoHit
+	//Connections returns the connection records of the user with id, oldest first
+	Connections(id int) []Connection
+	//Broadcasts returns the broadcasts of the patient with id, newest first
+	Broadcasts(patientId int) []Broadcast
+	//Requests returns the requests sent or received by the user with id, newest first
+	Requests(id int) []Request
+	//Notifications returns the notifications of the user with id after sinceId, newest first
+	Notifications(id int, sinceId int) []Notification
+	//VerifySecretCode resolves a secret code as typed by a user to its user.
+	//the raw code is only compared against its stored hash
+	VerifySecretCode(code string) (UserProtected, error)
+
+	//Credential returns the stored credential of the user with id
+	Credential(id int) (UserProtected, error)
+	//ReplaceCredential swaps the secret code of the user or staff member with
+	//id for cred and invalidates every session issued before
+	ReplaceCredential(by *AuditEntry, kind EventType, id int, cred SecretCredential) error
+
+	//CreateUser assigns user an id, stores it and registers cred for it
+	CreateUser(by *AuditEntry, user User, cred SecretCredential) (User, error)
+	//UpdateUser runs fn on a copy of the user with id and stores the result
+	//if fn returns nil
+	UpdateUser(by *AuditEntry, kind EventType, id int, fn func(user *User) error) (User, error)
+	//DeleteUser removes the user with id and its secret code, cancels its
+	//pending requests and strips it from the connections of its counterparts
+	DeleteUser(by *AuditEntry, id int) (DeleteSummary, error)
+	//RepairUser gives the user with id a new credential even if its secret code
+	//mappings are broken, dropping every stale credential that points at it
+	RepairUser(by *AuditEntry, id int, cred SecretCredential) (User, error)
+
+	//CreateStaff assigns member an id, stores it and registers cred for it
+	CreateStaff(by *AuditEntry, member StaffMember, cred SecretCredential) (StaffMember, error)
+	//GetStaff returns the staff member with id
+	GetStaff(id int) (StaffMember, error)
+	//ListStaff returns every staff member, in no particular order
+	ListStaff() []StaffMember
+	//UpdateStaff runs fn on a copy of the staff member with id and stores the
+	//result as one event of kind
+	UpdateStaff(by *AuditEntry, kind EventType, id int, fn func(member *StaffMember) error) (StaffMember, error)
+	//UpdatePair runs fn on copies of two users, the pending requests between
+	//them and their edges and stores the results in one step if fn returns nil.
+	//if fn returns an error neither user is changed
+	UpdatePair(by *AuditEntry, kind EventType, userId int, counterpartId int, fn func(tx *pairTx) error) error
+	//ExpireRequests expires the pending requests whose expiry is not after now
+	ExpireRequests(now time.Time) ([]Request, error)
+	//Fsck checks the invariants of the store and, with repair set, repairs what
+	//it can in the same step
+	Fsck(by *AuditEntry, repair bool) (FsckReport, error)
+
+	//CreateBroadcast assigns b an id and runs fn on it with copies of its patient,
+	//the donors with donorIds, the pending requests among them and their edges,
+	//storing them all in one step if fn returns nil
+	CreateBroadcast(by *AuditEntry, b Broadcast, donorIds []int, fn func(b *Broadcast, users map[int]*User, requests *requestBook, links *linkBook) error) (Broadcast, error)
+	//UpdateBroadcast runs fn on a copy of the broadcast with id, its patient,
+	//the donors it was sent to, the pending requests among them and their
+	//edges, storing them all in one step if fn returns nil
+	UpdateBroadcast(by *AuditEntry, kind EventType, id int, fn func(b *Broadcast, users map[int]*User, requests *requestBook, links *linkBook) error) (Broadcast, error)
+}
+
+//memStore keeps the Hospital in memory. reads share the lock, every event is
+//committed under it exclusively, so a read never sees half an event
+type memStore struct {
+	sync.RWMutex
+	hospital Hospital
+	//record is called with every event before it is applied, under the lock.
+	//if it fails the event is dropped
+	record func(ev Event) error
+	donors *geoIndex //locations of hospital.Donors
+	audit  *auditLog //where the audit entries of events are written once applied, nil drops them
+}
+
+func newMemStore(hospital Hospital) *memStore {
+	donors := newGeoIndex()
+	for _, donor := range hospital.Donors {
+		donors.put(donor)
+	}
+	return &memStore{
+		hospital: hospital,
+		donors:   donors,
+	}
+}
+
+//commit records and applies ev. the audit entry of ev is chained onto the
+//trail here, so it is journaled with ev and the trail is in the order of the
+//events. caller must hold the lock
+func (s *memStore) commit(ev Event) error {
+	ev.Seq = s.hospital.Seq + 1
+	ev.Time = time.Now().UTC()
+	if ev.Audit != nil && s.audit == nil {
+		ev.Audit = nil
+	}
+	if ev.Audit != nil {
+		entry := *ev.Audit
+		entry.Seq = s.hospital.AuditSeq + 1
+		entry.Time = ev.Time
+		entry.Action = string(ev.Type)
+		entry.TargetId = ev.UserId
+		entry.CounterpartId = ev.CounterpartId
+		if entry.ActorId == 0 {
+			//made by the user it creates, like a signup
+			entry.ActorId = ev.UserId
+		}
+		entry.PrevHash = s.hospital.AuditHead
+		entry.Hash = s.audit.sign(entry)
+		ev.Audit = &entry
+	}
+
+	//relationships are in the edges, the ids of users are output only
+	users := make([]User, len(ev.Users))
+	for i, user := range ev.Users {
+		users[i] = withoutRelations(user)
+	}
+	ev.Users = users
+
+	if s.record != nil {
+		if err := s.record(ev); err != nil {
+			return err
+		}
+	}
+	s.hospital.apply(ev)
+
+	for _, user := range ev.Users {
+		if user.Type == Donor {
+			s.donors.put(user)
+		}
+	}
+	for _, id := range ev.Deleted {
+		s.donors.remove(id)
+	}
+
+	//the event is journaled with its entry, a failed write is made up for on the next start
+	if ev.Audit != nil {
+		if err := s.audit.append(*ev.Audit); err != nil {
+			fmt.Fprintln(os.Stderr, "audit write failed:", err)
+		}
+	}
+	return nil
+}
+
+//attachAudit starts writing the audit entries of events to a, after catching
+//a up with the entries in journaled it misses
+func (s *memStore) attachAudit(a *auditLog, journaled []AuditEntry) error {
+	s.Lock()
+	defer s.Unlock()
+
+	s.audit = a
+	return a.catchUp(journaled, s.hospital.AuditSeq, s.hospital.AuditHead)
+}
+
+//getUser resolves id through both secret code maps, like login does. caller must hold the lock, shared or not
+func (s *memStore) getUser(id int) (User, error) {
+	selector, ok := s.hospital.IdsToSelectors[id]
+	if !ok {
+		return User{}, ErrUserNotFound
+	}
+	config, ok := s.hospital.Credentials[selector]
+	if !ok || config.Id != id {
+		return User{}, ErrCodeMismatch
+	}
+
+	var user User
+	switch config.Type {
+	case Donor:
+		user, ok = s.hospital.Donors[id]
+	case Patient:
+		user, ok = s.hospital.Patients[id]
+	default:
+		//staff are not users
+		return User{}, ErrUserNotFound
+	}
+	if !ok {
+		return User{}, ErrCodeMismatch
+	}
+	return s.hospital.withRelations(user), nil
+}
+
+func (s *memStore) GetUser(id int) (User, error) {
+	s.RLock()
+	defer s.RUnlock()
+	return s.getUser(id)
+}
+
+func (s *memStore) ListUsers(t UserType) []User {
+	s.RLock()
+	defer s.RUnlock()
+
+	users := s.hospital.Patients
+	if t == Donor {
+		users = s.hospital.Donors
+	}
+	list := make([]User, 0, len(users))
+	for _, user := range users {
+		list = append(list, s.hospital.withRelations(user))
+	}
+	return list
+}
+
+func (s *memStore) DonorsNear(center Location, radiusKm float64) []geoHit {
+	s.RLock()
+	defer s.RUnlock()
+	return s.donors.near(center, radiusKm)
+}
+
+func (s *memStore) Connections(id int) []Connection {
+	s.RLock()
+	defer s.RUnlock()
+	return s.hospital.connectionsOf(id)
+}
+
+func (s *memStore) Broadcasts(patientId int) []Broadcast {
+	s.RLock()
+	defer s.RUnlock()
+	return s.hospital.broadcastsOf(patientId)
+}
+
+func (s *memStore) Requests(id int) []Request {
+	s.RLock()
+	defer s.RUnlock()
+	return s.hospital.requestsOf(id)
+}
+
+func (s *memStore) Notifications(id int, sinceId int) []Notification {
+	s.RLock()
+	defer s.RUnlock()
+	return s.hospital.notificationsOf(id, sinceId)
+}
+
+func (s *memStore) VerifySecretCode(code string) (UserProtected, error) {
+	selector, plain, err := parseSecretCode(code)
+	if err != nil {
+		return UserProtected{}, err
+	}
+
+	s.RLock()
+	config, ok := s.hospital.Credentials[selector]
+	s.RUnlock()
+
+	if !ok || !config.verify(plain) {
+		return UserProtected{}, ErrUnknownSecret
+	}
+	return config, nil
+}
+
+func (s *memStore) Credential(id int) (UserProtected, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	selector, ok := s.hospital.IdsToSelectors[id]
+	if !ok {
+		return UserProtected{}, ErrUserNotFound
+	}
+	config, ok := s.hospital.Credentials[selector]
+	if !ok {
+		return UserProtected{}, ErrCodeMismatch
+	}
+	return config, nil
+}
+
+func (s *memStore) ReplaceCredential(by *AuditEntry, kind EventType, id int, cred SecretCredential) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if _, isStaff := s.hospital.Staff[id]; !isStaff {
+		if _, err := s.getUser(id); err != nil {
+			return err
+		}
+	}
+	if _, taken := s.hospital.Credentials[cred.Selector]; taken {
+		return ErrSelectorTaken
+	}
+	old := s.hospital.Credentials[s.hospital.IdsToSelectors[id]]
+	cred.SessionVersion = old.SessionVersion + 1
+	return s.commit(Event{Type: kind, UserId: id, Credential: &cred, Audit: by})
+}
+
+func (s *memStore) CreateUser(by *AuditEntry, user User, cred SecretCredential) (User, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if _, taken := s.hospital.Credentials[cred.Selector]; taken {
+		return User{}, ErrSelectorTaken
+	}
+	user.Id = s.hospital.allocateId()
+	err := s.commit(Event{Type: EventSignup, UserId: user.Id, Users: []User{user}, Credential: &cred, Audit: by})
+	return user, err
+}
+
+func (s *memStore) UpdateUser(by *AuditEntry, kind EventType, id int, fn func(user *User) error) (User, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	user, err := s.getUser(id)
+	if err != nil {
+		return User{}, err
+	}
+	user = cloneUser(user)
+	if err := fn(&user); err != nil {
+		if err == errNoChange {
+			return s.getUser(id)
+		}
+		return User{}, err
+	}
+	if err := s.commit(Event{Type: kind, UserId: id, Users: []User{user}, Audit: by}); err != nil {
+		return User{}, err
+	}
+	return s.getUser(id)
+}
+
+func (s *memStore) DeleteUser(by *AuditEntry, id int) (DeleteSummary, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	user, err := s.getUser(id)
+	if err != nil {
+		return DeleteSummary{}, err
+	}
+	ev, summary := s.hospital.cascadeDelete(user, time.Now().UTC())
+	ev.Audit = by
+	if err := s.commit(ev); err != nil {
+		return DeleteSummary{}, err
+	}
+	return summary, nil
+}
+
+func (s *memStore) UpdatePair(by *AuditEntry, kind EventType, userId int, counterpartId int, fn func(tx *pairTx) error) error {
+	s.Lock()
+	defer s.Unlock()
+
+	user, err := s.getUser(userId)
+	if err != nil {
+		return err
+	}
+	counterpart, err := s.getUser(counterpartId)
+	if err != nil {
+		return err
+	}
+
+	//fn works on copies, so the slices must not share backing arrays with the store
+	user = cloneUser(user)
+	counterpart = cloneUser(counterpart)
+	tx := &pairTx{
+		user:        &user,
+		counterpart: &counterpart,
+		links:       s.hospital.linkBook(),
+		others:      map[int]*User{},
+	}
+	ids := []int{userId, counterpartId}
+	if _, patient := donorAndPatient(user, counterpart); patient.Type == Patient {
+		for _, b := range s.hospital.broadcastsOf(patient.Id) {
+			if b.Status != BroadcastOpen {
+				continue
+			}
+			b = cloneBroadcast(b)
+			tx.broadcasts = append(tx.broadcasts, &b)
+			for id, response := range b.Responses {
+				if response != ResponsePending || id == userId || id == counterpartId || tx.others[id] != nil {
+					continue
+				}
+				if donor, err := s.getUser(id); err == nil && donor.Type == Donor {
+					donor = cloneUser(donor)
+					tx.others[id] = &donor
+					ids = append(ids, id)
+				}
+			}
+		}
+	}
+	tx.requests = s.hospital.requestBook(ids...)
+
+	if err := fn(tx); err != nil {
+		if err == errNoChange {
+			return nil
+		}
+		return err
+	}
+
+	users := []User{user, counterpart}
+	broadcasts := []Broadcast{}
+	if len(tx.filled) > 0 {
+		for _, id := range ids[2:] {
+			users = append(users, *tx.others[id])
+		}
+		for _, b := range tx.filled {
+			broadcasts = append(broadcasts, *b)
+		}
+	}
+	linked, unlinked := tx.links.changes()
+	return s.commit(Event{Type: kind, UserId: userId, CounterpartId: counterpartId, Users: users, Broadcasts: broadcasts, Requests: tx.requests.changes(), Linked: linked, Unlinked: unlinked, Audit: by})
+}
+
+func (s *memStore) Fsck(by *AuditEntry, repair bool) (FsckReport, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	violations, events := s.hospital.fsck()
+	report := FsckReport{
+		Seq:        s.hospital.Seq,
+		Checked:    len(s.hospital.Patients) + len(s.hospital.Donors),
+		Violations: violations,
+	}
+	if !repair || len(events) == 0 {
+		return report, nil
+	}
+	//the repair is audited once, with its last event
+	events[len(events)-1].Audit = by
+	for _, ev := range events {
+		if err := s.commit(ev); err != nil {
+			return report, err
+		}
+	}
+	report.Repaired = true
+	report.Seq = s.hospital.Seq
+	report.Remaining, _ = s.hospital.fsck()
+	return report, nil
+}
+
+func (s *memStore) ExpireRequests(now time.Time) ([]Request, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	expired := s.hospital.expiredRequests(now)
+	if len(expired) == 0 {
+		return nil, nil
+	}
+	if err := s.commit(Event{Type: EventExpireRequests, Requests: expired}); err != nil {
+		return nil, err
+	}
+	return expired, nil
+}
+
+func (s *memStore) CreateBroadcast(by *AuditEntry, b Broadcast, donorIds []int, fn func(b *Broadcast, users map[int]*User, requests *requestBook, links *linkBook) error) (Broadcast, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	b.Id = len(s.hospital.Broadcasts) + 1
+	b.CreatedAt = time.Now().UTC()
+	return s.updateBroadcast(by, EventBroadcast, cloneBroadcast(b), donorIds, fn)
+}
+
+func (s *memStore) UpdateBroadcast(by *AuditEntry, kind EventType, id int, fn func(b *Broadcast, users map[int]*User, requests *requestBook, links *linkBook) error) (Broadcast, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	b, ok := s.hospital.Broadcasts[id]
+	if !ok {
+		return Broadcast{}, ErrBroadcastNotFound
+	}
+	donorIds := make([]int, 0, len(b.Responses))
+	for donorId := range b.Responses {
+		donorIds = append(donorIds, donorId)
+	}
+	return s.updateBroadcast(by, kind, cloneBroadcast(b), donorIds, fn)
+}
+
+//updateBroadcast runs fn on b and copies of the users it touches and commits
+//the result. donors that no longer exist are left out. caller must hold the lock
+func (s *memStore) updateBroadcast(by *AuditEntry, kind EventType, b Broadcast, donorIds []int, fn func(b *Broadcast, users map[int]*User, requests *requestBook, links *linkBook) error) (Broadcast, error) {
+	patient, err := s.getUser(b.PatientId)
+	if err != nil {
+		return Broadcast{}, err
+	}
+	patient = cloneUser(patient)
+	users := map[int]*User{patient.Id: &patient}
+	ids := []int{patient.Id}
+	for _, id := range donorIds {
+		if donor, err := s.getUser(id); err == nil && donor.Type == Donor {
+			donor = cloneUser(donor)
+			users[id] = &donor
+			ids = append(ids, id)
+		}
+	}
+	requests := s.hospital.requestBook(ids...)
+	links := s.hospital.linkBook()
+
+	if err := fn(&b, users, requests, links); err != nil {
+		if err == errNoChange {
+			return s.hospital.Broadcasts[b.Id], nil
+		}
+		return Broadcast{}, err
+	}
+
+	//the patient first, then only the donors b reached
+	changed := []User{patient}
+	for id, user := range users {
+		if _, ok := b.Responses[id]; ok {
+			changed = append(changed, *user)
+		}
+	}
+	linked, unlinked := links.changes()
+	if err := s.commit(Event{Type: kind, UserId: b.PatientId, Users: changed, Broadcasts: []Broadcast{b}, Requests: requests.changes(), Linked: linked, Unlinked: unlinked, Audit: by}); err != nil {
+		return Broadcast{}, err
+	}
+	return s.hospital.Broadcasts[b.Id], nil
+}
+
+func (s *memStore) RepairUser(by *AuditEntry, id int, cred SecretCredential) (User, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	patient, isPatient := s.hospital.Patients[id]
+	donor, isDonor := s.hospital.Donors[id]
+	var user User
+	switch {
+	case isPatient && isDonor:
+		return User{}, ErrUserConflict
+	case isPatient:
+		user = patient
+		user.Type = Patient
+	case isDonor:
+		user = donor
+		user.Type = Donor
+	default:
+		return User{}, ErrUserNotFound
+	}
+	if _, taken := s.hospital.Credentials[cred.Selector]; taken {
+		return User{}, ErrSelectorTaken
+	}
+
+	var stale []string
+	for selector, config := range s.hospital.Credentials {
+		if config.Id == id {
+			stale = append(stale, selector)
+			if config.SessionVersion >= cred.SessionVersion {
+				cred.SessionVersion = config.SessionVersion + 1
+			}
+		}
+	}
+
+	err := s.commit(Event{Type: EventRepairUser, UserId: id, Users: []User{user}, Credential: &cred, RevokedSelectors: stale, Audit: by})
+	return s.hospital.withRelations(user), err
+}
+
+func (s *memStore) CreateStaff(by *AuditEntry, member StaffMember, cred SecretCredential) (StaffMember, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if _, taken := s.hospital.Credentials[cred.Selector]; taken {
+		return StaffMember{}, ErrSelectorTaken
+	}
+	member.Id = s.hospital.allocateId()
+	err := s.commit(Event{Type: EventCreateStaff, UserId: member.Id, Staff: []StaffMember{member}, Credential: &cred, Audit: by})
+	return member, err
+}
+
+func (s *memStore) GetStaff(id int) (StaffMember, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	member, ok := s.hospital.Staff[id]
+	if !ok {
+		return StaffMember{}, ErrUserNotFound
+	}
+	return member, nil
+}
+
+func (s *memStore) ListStaff() []StaffMember {
+	s.RLock()
+	defer s.RUnlock()
+
+	list := make([]StaffMember, 0, len(s.hospital.Staff))
+	for _, member := range s.hospital.Staff {
+		list = append(list, member)
+	}
+	return list
+}
+
+func (s *memStore) UpdateStaff(by *AuditEntry, kind EventType, id int, fn func(member *StaffMember) error) (StaffMember, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	member, ok := s.hospital.Staff[id]
+	if !ok {
+		return StaffMember{}, ErrUserNotFound
+	}
+	if err := fn(&member); err != nil {
+		if err == errNoChange {
+			return s.hospital.Staff[id], nil
+		}
+		return StaffMember{}, err
+	}
+	if err := s.commit(Event{Type: kind, UserId: id, Staff: []StaffMember{member}, Audit: by}); err != nil {
+		return StaffMember{}, err
+	}
+	return member, nil
+}
+
+//cloneUser copies the id slices of user so they can be edited in place
+func cloneUser(user User) User {
+	user.RequestedUserIds = append([]int(nil), user.RequestedUserIds...)
+	user.PendingUserIds = append([]int(nil), user.PendingUserIds...)
+	user.ConnectedUsersIds = append([]int(nil), user.ConnectedUsersIds...)
+	user.BlockedUserIds = append([]int(nil), user.BlockedUserIds...)
+	user.Deferrals = append([]Deferral(nil), user.Deferrals...)
+	user.OfferedTypes = append([]string(nil), user.OfferedTypes...)
+	user.NeededTypes = append([]string(nil), user.NeededTypes...)
+	if user.HLA != nil {
+		hla := HLATyping{
+			A:    append([]string(nil), user.HLA.A...),
+			B:    append([]string(nil), user.HLA.B...),
+			C:    append([]string(nil), user.HLA.C...),
+			DRB1: append([]string(nil), user.HLA.DRB1...),
+			DQB1: append([]string(nil), user.HLA.DQB1...),
+		}
+		user.HLA = &hla
+	}
+	if user.Location != nil {
+		loc := *user.Location
+		user.Location = &loc
+	}
+	return user
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestUpdatePairFailureChangesNothing(t *testing.T) {
+	errRefused := errors.New("refused")
+	tests := []struct {
+		name        string
+		donor       int //index of the donor of the pair
+		fn          func(tx *pairTx) error
+		wantErr     bool
+		wantChanged bool
+	}{
+		{"accept fails after connecting", 0, func(tx *pairTx) error {
+			tx.requests.settle(tx.counterpart.Id, tx.user.Id, RequestAccepted)
+			tx.connect()
+			tx.user.RequestsAnswered += 1
+			tx.fillBroadcasts()
+			return errRefused
+		}, true, false},
+		{"send fails after opening", 2, func(tx *pairTx) error {
+			tx.requests.open(tx.counterpart.Id, tx.user.Id, "", time.Hour)
+			tx.counterpart.Name = "changed"
+			return &httpError{400, "refused"}
+		}, true, false},
+		{"block fails after cancelling", 1, func(tx *pairTx) error {
+			tx.requests.settle(tx.counterpart.Id, tx.user.Id, RequestCancelled)
+			tx.block()
+			return errRefused
+		}, true, false},
+		{"nothing to do after staging", 0, func(tx *pairTx) error {
+			tx.connect()
+			tx.user.Unavailable = true
+			return errNoChange
+		}, false, false},
+		{"accept", 0, func(tx *pairTx) error {
+			tx.requests.settle(tx.counterpart.Id, tx.user.Id, RequestAccepted)
+			tx.connect()
+			tx.fillBroadcasts()
+			return nil
+		}, false, true},
+	}
+	for _, tt := range tests {
+		store := newMemStore(emptyHospital())
+		patient := addTestUser(t, store, Patient, "A+")
+		donors := []User{addTestUser(t, store, Donor, "O-"), addTestUser(t, store, Donor, "O-"), addTestUser(t, store, Donor, "O-")}
+		//the patient asked the first two donors through a broadcast needing one of them
+		b := Broadcast{PatientId: patient.Id, DonorsNeeded: 1, Status: BroadcastOpen, Responses: map[int]string{}}
+		_, err := store.CreateBroadcast(nil, b, []int{donors[0].Id, donors[1].Id}, func(b *Broadcast, users map[int]*User, requests *requestBook, links *linkBook) error {
+			for _, donor := range donors[:2] {
+				request := requests.open(patient.Id, donor.Id, "", time.Hour)
+				request.BroadcastId = b.Id
+				requests.put(request)
+				b.Responses[donor.Id] = ResponsePending
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		before, _ := json.Marshal(store.hospital)
+		err = store.UpdatePair(nil, EventAcceptRequest, donors[tt.donor].Id, patient.Id, tt.fn)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: got %v, want an error %v", tt.name, err, tt.wantErr)
+		}
+		after, _ := json.Marshal(store.hospital)
+		if changed := string(before) != string(after); changed != tt.wantChanged {
+			t.Errorf("%s: store changed %v, want %v", tt.name, changed, tt.wantChanged)
+		}
+		if !tt.wantChanged {
+			continue
+		}
+		if !store.hospital.Graph.has(EdgeConnected, patient.Id, donors[tt.donor].Id) {
+			t.Errorf("%s: pair not connected", tt.name)
+		}
+		if got := store.hospital.Broadcasts[1].Status; got != BroadcastFilled {
+			t.Errorf("%s: broadcast is %s, want %s", tt.name, got, BroadcastFilled)
+		}
+		if store.hospital.Graph.has(EdgeRequested, patient.Id, donors[1].Id) {
+			t.Errorf("%s: request of the filled broadcast left pending", tt.name)
+		}
+	}
+}
+
+//benchStore fills store with pairs patients and as many donors. patient i
+//only ever deals with donor i, so the store does not grow while the
+//benchmark runs
+func benchStore(b *testing.B, store *memStore, pairs int) ([]int, []int) {
+	patients := make([]int, 0, pairs)
+	donors := make([]int, 0, pairs)
+	for i := 0; i < pairs*2; i++ {
+		user := User{Name: "bench", Address: "bench", PhoneNo: "1", Type: Patient, BloodGroup: "A+"}
+		if i%2 == 1 {
+			user.Type = Donor
+			user.BloodGroup = "O-"
+		}
+		cred, err := hashSecretCode(fmt.Sprintf("bench-%d", i), strconv.Itoa(i))
+		if err != nil {
+			b.Fatal(err)
+		}
+		if user, err = store.CreateUser(nil, user, cred); err != nil {
+			b.Fatal(err)
+		}
+		if user.Type == Donor {
+			donors = append(donors, user.Id)
+		} else {
+			patients = append(patients, user.Id)
+		}
+	}
+	return patients, donors
+}
+
+//pairStore is the part of the store the benchmarks drive
+type pairStore interface {
+	GetUser(id int) (User, error)
+	UpdatePair(by *AuditEntry, kind EventType, userId int, counterpartId int, fn func(tx *pairTx) error) error
+}
+
+//mutexStore serializes every call to a memStore behind one sync.Mutex, the
+//baseline the read-write lock of memStore is measured against
+type mutexStore struct {
+	sync.Mutex
+	store *memStore
+}
+
+func (s *mutexStore) GetUser(id int) (User, error) {
+	s.Lock()
+	defer s.Unlock()
+	return s.store.GetUser(id)
+}
+
+func (s *mutexStore) UpdatePair(by *AuditEntry, kind EventType, userId int, counterpartId int, fn func(tx *pairTx) error) error {
+	s.Lock()
+	defer s.Unlock()
+	return s.store.UpdatePair(by, kind, userId, counterpartId, fn)
+}
+
+//benchMix measures store under reads percent of GetUser calls, the rest
+//connecting or disconnecting a patient and its donor through UpdatePair.
+//run it with -cpu 1,2,4 to see how it scales
+func benchMix(b *testing.B, store pairStore, patients []int, donors []int, reads int) {
+	var seed int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		rnd := rand.New(rand.NewSource(time.Now().UnixNano() + atomic.AddInt64(&seed, 1)))
+		for pb.Next() {
+			i := rnd.Intn(len(patients))
+			if rnd.Intn(100) < reads {
+				if _, err := store.GetUser(donors[i]); err != nil {
+					b.Fatal(err)
+				}
+				continue
+			}
+			err := store.UpdatePair(nil, EventAcceptRequest, patients[i], donors[i], func(tx *pairTx) error {
+				if !tx.disconnect() {
+					tx.connect()
+				}
+				return nil
+			})
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+//benchPairs is the number of patients, and of donors, in the benchmark store
+const benchPairs = 1000
+
+//benchMixes runs benchMix for each share of reads, on the in-memory store as
+//it is and behind the mutex baseline, and on a store journaling to disk,
+//which syncs every change and compacts under the write lock
+func benchMixes(b *testing.B, reads int) {
+	store := newMemStore(emptyHospital())
+	patients, donors := benchStore(b, store, benchPairs)
+	b.Run("rwmutex", func(b *testing.B) {
+		benchMix(b, store, patients, donors, reads)
+	})
+	b.Run("mutex", func(b *testing.B) {
+		benchMix(b, &mutexStore{store: store}, patients, donors, reads)
+	})
+	b.Run("file", func(b *testing.B) {
+		fs, err := openFileStore(filepath.Join(b.TempDir(), "store.json"), 100, false)
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer fs.Close()
+		patients, donors := benchStore(b, fs.memStore, benchPairs)
+		benchMix(b, fs, patients, donors, reads)
+	})
+}
+
+func BenchmarkStoreReads100(b *testing.B) { benchMixes(b, 100) }
+func BenchmarkStoreReads90(b *testing.B)  { benchMixes(b, 90) }
+func BenchmarkStoreReads50(b *testing.B)  { benchMixes(b, 50) }
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//counter is a login counter, safe for concurrent use
+type counter struct {
+	n int64
+}
+
+func (c *counter) Add(delta int64) {
+	atomic.AddInt64(&c.n, delta)
+}
+
+func (c *counter) Value() int64 {
+	return atomic.LoadInt64(&c.n)
+}
+
+//login counters, served to staff at /admin/logins
+var (
+	loginAttempts  = &counter{}
+	loginFailures  = &counter{}
+	loginThrottled = &counter{}
+	loginLockouts  = &counter{}
+)
+
+//loginThrottle slows down secret code guessing. every ip gets freeAttempts
+//failed logins, after that it is locked out for baseLockout, doubling with
+//each further failure up to maxLockout. on top of that at most globalLimit
+//failures from all ips together are allowed per globalWindow. a successful
+//login does not clear the failures of an ip, or one valid code would let it
+//guess on forever. they are only forgotten after forgetAfter without one.
+//attempts still being checked count as failures until they are settled, so
+//a burst of concurrent guesses gets no further than the same guesses in turn
+type loginThrottle struct {
+	sync.Mutex
+	freeAttempts int
+	baseLockout  time.Duration
+	maxLockout   time.Duration
+	forgetAfter  time.Duration //an ip without failures for this long starts over
+
+	globalLimit  int
+	globalWindow time.Duration
+
+	ips            map[string]*ipAttempts
+	lastSweep      time.Time
+	windowStart    time.Time
+	windowFailures int
+	pending        int //attempts from all ips not settled yet
+}
+
+type ipAttempts struct {
+	failures    int
+	pending     int
+	lastFailure time.Time
+	lockedUntil time.Time
+}
+
+//loginAttempt is an attempt let through by loginThrottle.allow. it has to be
+//settled with failed or done once the code is checked
+type loginAttempt struct {
+	throttle *loginThrottle
+	ip       string
+	settled  bool
+}
+
+func newLoginThrottle() *loginThrottle {
+	t := &loginThrottle{
+		freeAttempts: 5,
+		baseLockout:  time.Second,
+		maxLockout:   15 * time.Minute,
+		forgetAfter:  time.Hour,
+		globalLimit:  300,
+		globalWindow: time.Minute,
+		ips:          map[string]*ipAttempts{},
+	}
+	return t
+}
+
+//clientIp is the address the request came from. forwarding headers are not
+//trusted since any client can set them
+func clientIp(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+//allow reserves an attempt for ip if it may attempt a login now. if not it
+//returns nil and how long ip has to wait
+func (t *loginThrottle) allow(ip string) (*loginAttempt, time.Duration) {
+	t.Lock()
+	defer t.Unlock()
+
+	now := time.Now()
+	if now.Sub(t.windowStart) >= t.globalWindow {
+		t.windowStart = now
+		t.windowFailures = 0
+	}
+	if t.windowFailures+t.pending >= t.globalLimit {
+		return nil, t.windowStart.Add(t.globalWindow).Sub(now)
+	}
+
+	a, ok := t.ips[ip]
+	if !ok {
+		a = &ipAttempts{}
+		t.ips[ip] = a
+	}
+	if now.Before(a.lockedUntil) {
+		return nil, a.lockedUntil.Sub(now)
+	}
+	//past the free attempts only one attempt at a time, since its failure locks ip out
+	if a.failures+a.pending >= t.freeAttempts && a.pending > 0 {
+		return nil, t.baseLockout
+	}
+	a.pending += 1
+	t.pending += 1
+	return &loginAttempt{throttle: t, ip: ip}, 0
+}
+
+//failed settles the attempt as a failed login
+func (l *loginAttempt) failed() {
+	if l.settled {
+		return
+	}
+	l.settled = true
+	l.throttle.settle(l.ip, true)
+}
+
+//done settles the attempt without a failure, if it was not settled already.
+//it is meant to be deferred right after allow
+func (l *loginAttempt) done() {
+	if l.settled {
+		return
+	}
+	l.settled = true
+	l.throttle.settle(l.ip, false)
+}
+
+//settle releases an attempt reserved for ip, recording a failure if it failed
+func (t *loginThrottle) settle(ip string, failed bool) {
+	t.Lock()
+	defer t.Unlock()
+
+	now := time.Now()
+	a := t.ips[ip]
+	a.pending -= 1
+	t.pending -= 1
+	if failed {
+		t.windowFailures += 1
+		a.failures += 1
+		a.lastFailure = now
+		if over := a.failures - t.freeAttempts; over >= 0 {
+			lockout := time.Duration(float64(t.baseLockout) * math.Pow(2, float64(over)))
+			if lockout > t.maxLockout || lockout <= 0 {
+				lockout = t.maxLockout
+			}
+			a.lockedUntil = now.Add(lockout)
+			loginLockouts.Add(1)
+		}
+	}
+	t.forget(now)
+}
+
+//forget drops ips that have not failed for a while, at most once a minute.
+//caller must hold the lock
+func (t *loginThrottle) forget(now time.Time) {
+	if now.Sub(t.lastSweep) < time.Minute {
+		return
+	}
+	t.lastSweep = now
+	for ip, a := range t.ips {
+		if a.pending == 0 && now.Sub(a.lastFailure) > t.forgetAfter && now.After(a.lockedUntil) {
+			delete(t.ips, ip)
+		}
+	}
+}
+
+func (t *loginThrottle) lockedIps() int {
+	t.Lock()
+	defer t.Unlock()
+
+	now := time.Now()
+	locked := 0
+	for _, a := range t.ips {
+		if now.Before(a.lockedUntil) {
+			locked += 1
+		}
+	}
+	return locked
+}
+
+// GET /admin/logins
+//loginStats returns the login counters and how many ips are locked out now
+func (h *usersHandler) loginStats(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, struct {
+		Attempts  int64 `json:"login_attempts"`
+		Failures  int64 `json:"login_failures"`
+		Throttled int64 `json:"login_throttled"`
+		Lockouts  int64 `json:"login_lockouts"`
+		LockedIps int   `json:"login_locked_ips"`
+	}{
+		Attempts:  loginAttempts.Value(),
+		Failures:  loginFailures.Value(),
+		Throttled: loginThrottled.Value(),
+		Lockouts:  loginLockouts.Value(),
+		LockedIps: h.throttle.lockedIps(),
+	})
+}
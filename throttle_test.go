@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLoginThrottleLockout(t *testing.T) {
+	throttle := newLoginThrottle()
+	const ip = "192.0.2.1"
+
+	for n := 1; n <= throttle.freeAttempts+3; n++ {
+		attempt, wait := throttle.allow(ip)
+		if attempt == nil {
+			t.Fatalf("attempt %d refused for %v", n, wait)
+		}
+		attempt.failed()
+		attempt.done() //settled already, must not release twice
+
+		a := throttle.ips[ip]
+		if a.pending != 0 || throttle.pending != 0 {
+			t.Fatalf("attempt %d: %d pending for ip, %d in all, want none", n, a.pending, throttle.pending)
+		}
+		var want time.Duration
+		if over := n - throttle.freeAttempts; over >= 0 {
+			want = throttle.baseLockout << uint(over)
+		}
+		if got := a.lockedUntil.Sub(a.lastFailure); want > 0 && got != want {
+			t.Errorf("after %d failures: locked out for %v, want %v", n, got, want)
+		}
+		if attempt, _ := throttle.allow(ip); (attempt == nil) != (want > 0) {
+			t.Errorf("after %d failures: refused %v, want %v", n, attempt == nil, want > 0)
+		} else if attempt != nil {
+			attempt.done()
+		}
+		//let the lockout run out
+		a.lockedUntil = time.Time{}
+	}
+}
+
+func TestLoginThrottleDoneKeepsFailures(t *testing.T) {
+	throttle := newLoginThrottle()
+	const ip = "192.0.2.1"
+
+	for i := 0; i < throttle.freeAttempts-1; i++ {
+		attempt, _ := throttle.allow(ip)
+		attempt.failed()
+	}
+	attempt, _ := throttle.allow(ip)
+	attempt.done()
+	if a := throttle.ips[ip]; a.failures != throttle.freeAttempts-1 || a.pending != 0 {
+		t.Errorf("%d failures and %d pending after a good login, want %d and 0", a.failures, a.pending, throttle.freeAttempts-1)
+	}
+}
+
+//burst lets every caller ask allow at once and only then settles the attempts
+//that got through as failures. it returns how many got through
+func burst(throttle *loginThrottle, ips []string) int {
+	var reserved, settled sync.WaitGroup
+	release := make(chan struct{})
+	var mu sync.Mutex
+	allowed := 0
+
+	for _, ip := range ips {
+		reserved.Add(1)
+		settled.Add(1)
+		go func(ip string) {
+			defer settled.Done()
+			attempt, _ := throttle.allow(ip)
+			reserved.Done()
+			<-release
+			if attempt == nil {
+				return
+			}
+			mu.Lock()
+			allowed += 1
+			mu.Unlock()
+			attempt.failed()
+		}(ip)
+	}
+	reserved.Wait()
+	close(release)
+	settled.Wait()
+	return allowed
+}
+
+func TestLoginThrottleConcurrentBurst(t *testing.T) {
+	tests := []struct {
+		name        string
+		ips         int
+		perIp       int
+		globalLimit int
+		want        int
+	}{
+		{"one ip", 1, 50, 300, 5},
+		{"many ips", 20, 10, 300, 20 * 5},
+		{"global limit", 50, 1, 30, 30},
+	}
+	for _, tt := range tests {
+		throttle := newLoginThrottle()
+		throttle.globalLimit = tt.globalLimit
+
+		ips := []string{}
+		for i := 0; i < tt.ips; i++ {
+			for j := 0; j < tt.perIp; j++ {
+				ips = append(ips, fmt.Sprintf("192.0.2.%d", i+1))
+			}
+		}
+		if got := burst(throttle, ips); got != tt.want {
+			t.Errorf("%s: %d attempts got through, want %d", tt.name, got, tt.want)
+		}
+		if throttle.pending != 0 {
+			t.Errorf("%s: %d attempts still pending", tt.name, throttle.pending)
+		}
+		if tt.perIp > throttle.freeAttempts {
+			if attempt, _ := throttle.allow(ips[0]); attempt != nil {
+				t.Errorf("%s: %s not locked out after the burst", tt.name, ips[0])
+			}
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+//pairTx is one transition between a user and its counterpart. it works on
+//copies of both users, the pending requests between them and a view of their
+//edges: preconditions are checked against those, changes are staged on them,
+//and the store keeps the result only if the func running the transition
+//returns nil. copies of the open broadcasts of the patient, and of the donors
+//still to answer them, come along so a connection can fill them in the same step
+type pairTx struct {
+	user        *User
+	counterpart *User
+	requests    *requestBook
+	links       *linkBook
+
+	broadcasts []*Broadcast
+	others     map[int]*User //donors of broadcasts other than the pair
+	filled     []*Broadcast
+}
+
+//connected reports whether the user and the counterpart are connected
+func (tx *pairTx) connected() bool {
+	return tx.links.has(EdgeConnected, tx.user.Id, tx.counterpart.Id)
+}
+
+//connect stages connecting the user and the counterpart
+func (tx *pairTx) connect() {
+	tx.links.link(EdgeConnected, tx.user.Id, tx.counterpart.Id)
+}
+
+//disconnect stages dropping the connection, reporting whether there was one
+func (tx *pairTx) disconnect() bool {
+	return tx.links.unlink(EdgeConnected, tx.user.Id, tx.counterpart.Id)
+}
+
+//block stages the user refusing requests from the counterpart
+func (tx *pairTx) block() {
+	tx.links.link(EdgeBlocked, tx.user.Id, tx.counterpart.Id)
+}
+
+//unblock stages the user accepting requests from the counterpart again,
+//reporting whether it refused them
+func (tx *pairTx) unblock() bool {
+	return tx.links.unlink(EdgeBlocked, tx.user.Id, tx.counterpart.Id)
+}
+
+//fillBroadcasts marks the donor of the pair as accepted in the broadcast it
+//was asked through, and closes the broadcasts that have as many donors as they
+//need, cancelling the requests no one answered. called once the pair is
+//connected, no donor can accept in between
+func (tx *pairTx) fillBroadcasts() {
+	donor, patient := tx.user, tx.counterpart
+	if donor.Type != Donor {
+		donor, patient = patient, donor
+	}
+	users := map[int]*User{patient.Id: patient, donor.Id: donor}
+	for id, other := range tx.others {
+		users[id] = other
+	}
+
+	for _, b := range tx.broadcasts {
+		if b.Responses[donor.Id] == ResponsePending {
+			b.Responses[donor.Id] = ResponseAccepted
+		}
+		if b.count(ResponseAccepted) < b.DonorsNeeded {
+			continue
+		}
+		b.close(BroadcastFilled, users, tx.requests, tx.requests.now)
+		tx.filled = append(tx.filled, b)
+	}
+}
+
+//transition runs fn as one transaction on the users of /user/{id}/request/{id},
+//after checking the counterpart is of the other type. fn returns an httpError
+//to refuse the transition or errNoChange when there is nothing to do. the
+//transition is audited as kind, and the users as they were before it are
+//returned. on failure the answer is written to w
+func (h *usersHandler) transition(w http.ResponseWriter, r *http.Request, kind EventType, t string, p string, fn func(tx *pairTx) error) (User, User, bool) {
+	currUser, requestUser, ok := h.parseUserPair(w, t, p)
+	if !ok {
+		return User{}, User{}, false
+	}
+
+	err := h.store.UpdatePair(audited(r), kind, currUser.Id, requestUser.Id, func(tx *pairTx) error {
+		if tx.counterpart.Type == tx.user.Type {
+			return &httpError{http.StatusNotFound, fmt.Sprintf("err: Check Input UserId. %sId : %d NOT FOUND", typeName(otherType(tx.user.Type)), tx.counterpart.Id)}
+		}
+		return fn(tx)
+	})
+	if err != nil {
+		writeStoreError(w, err, "UserId")
+		return User{}, User{}, false
+	}
+	return currUser, requestUser, true
+}